@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"slices"
 	"strings"
 	"time"
 )
@@ -11,77 +14,252 @@ import (
 // TokenClaims defines the structure for the JWT claims.
 type TokenClaims struct {
 	UserID int `json:"user_id"`
+	// Scopes limit permissions of the token. Empty scopes don't limit them
+	Scopes []string `json:"scopes,omitempty"`
+	// Derived marks credentials issued by the service itself in exchange for other ones, e.g. access tokens
+	// issued along with refresh tokens and API keys. Only tokens of the provider are exchanged for refresh tokens
+	Derived bool `json:"derived,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type Service interface {
-	GetClaims(token string) (claims *TokenClaims, err error)
+	GetClaims(ctx context.Context, token string) (claims *TokenClaims, err error)
+}
+
+// DefaultAlgorithms are accepted, if JwtService.Algorithms is empty
+var DefaultAlgorithms = []string{jwt.SigningMethodHS256.Alg()}
+
+// Errors of GetClaims, each of them wraps the original error
+var (
+	ErrInvalidTokenFormat = errors.New("invalid token format")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrTokenExpired       = errors.New("token is expired")
+	ErrTokenNotValidYet   = errors.New("token is not valid yet")
+	ErrTokenTooOld        = errors.New("token is too old")
+	ErrMissingClaim       = errors.New("token is missing a required claim")
+	ErrInvalidIssuer      = errors.New("token has invalid issuer")
+	ErrInvalidAudience    = errors.New("token has invalid audience")
+	ErrTokenRevoked       = errors.New("token is revoked")
+	// ErrRevocationUnavailable is returned, if the token can't be checked against the revocation list
+	ErrRevocationUnavailable = errors.New("token revocation list is unavailable")
+	// ErrCredentialsUnavailable is returned, if the credentials can't be looked up, e.g. the store of api keys is down
+	ErrCredentialsUnavailable = errors.New("credentials are unavailable")
+)
+
+// RevocationChecker reports whether the token was revoked by its jti or by revocation of all tokens of the user
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, claims *TokenClaims) (bool, error)
+}
+
+// ValidationOptions are checks of the registered claims
+type ValidationOptions struct {
+	// Issuer is a required iss, if not empty
+	Issuer string
+	// Audience is a list of accepted aud, the token must have one of them, if not empty
+	Audience []string
+	// RequireExp rejects tokens without exp
+	RequireExp bool
+	// MaxAge rejects tokens issued earlier, if greater than zero. Such tokens must have iat
+	MaxAge time.Duration
+	// Leeway is an allowed clock skew
+	Leeway time.Duration
 }
 
 type JwtService struct {
-	codePhrase string
-	TokenTTL   time.Duration
+	keys      *KeySet
+	providers []KeyProvider
+	TokenTTL  time.Duration
+	// Algorithms are accepted signing methods, tokens signed with other ones are rejected
+	Algorithms []string
+	Validation ValidationOptions
+	// Revocations are checked for every token, if set
+	Revocations RevocationChecker
 }
 
 func NewJwtService(codePhrase string) *JwtService {
-	return &JwtService{codePhrase: codePhrase}
+	return NewJwtServiceWithKeys(NewStaticKeySet(codePhrase))
+}
+
+// NewJwtServiceWithKeys creates a service, which signs tokens with the active key and verifies them by the kid header.
+// Tokens are also verified with keys of the providers, e.g. public keys of the identity provider.
+// keys may be nil, if the service only verifies tokens
+func NewJwtServiceWithKeys(keys *KeySet, providers ...KeyProvider) *JwtService {
+	if keys != nil {
+		providers = append([]KeyProvider{keys}, providers...)
+	}
+	return &JwtService{keys: keys, providers: providers}
 }
 
-func (service JwtService) GetClaims(token string) (claims *TokenClaims, err error) {
+func (service JwtService) GetClaims(ctx context.Context, token string) (claims *TokenClaims, err error) {
 	split := strings.Split(token, " ")
 
 	if len(split) != 2 || split[0] != "Bearer" {
-		err = errors.New("invalid token format")
+		err = ErrInvalidTokenFormat
 		return
 	}
 	claims = &TokenClaims{}
 
 	jwtToken, err := jwt.ParseWithClaims(split[1], claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(service.codePhrase), nil
-	})
+		return service.verificationKey(ctx, token)
+	}, service.parserOptions()...)
 	if err != nil {
-		return nil, err
+		return nil, claimsError(err)
 	}
 
 	// Validate the token and return the claims.
-	if claims, ok := jwtToken.Claims.(*TokenClaims); ok && jwtToken.Valid {
-		return claims, nil
+	claims, ok := jwtToken.Claims.(*TokenClaims)
+	if !ok || !jwtToken.Valid {
+		return nil, ErrInvalidToken
+	}
+	if err = service.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	if service.Revocations != nil {
+		revoked, err := service.Revocations.IsRevoked(ctx, claims)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRevocationUnavailable, err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	return claims, nil
+}
+
+func (service JwtService) parserOptions() []jwt.ParserOption {
+	algorithms := service.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultAlgorithms
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(algorithms),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(service.Validation.Leeway),
+	}
+	if service.Validation.Issuer != "" {
+		options = append(options, jwt.WithIssuer(service.Validation.Issuer))
+	}
+	if service.Validation.RequireExp {
+		options = append(options, jwt.WithExpirationRequired())
 	}
-	return nil, errors.New("invalid token")
+	return options
+}
+
+// validateClaims checks claims, which are not supported by the jwt parser
+func (service JwtService) validateClaims(claims *TokenClaims) error {
+	if len(service.Validation.Audience) > 0 {
+		if len(claims.Audience) == 0 {
+			return fmt.Errorf("%w: aud", ErrMissingClaim)
+		}
+		if !slices.ContainsFunc(claims.Audience, func(aud string) bool {
+			return slices.Contains(service.Validation.Audience, aud)
+		}) {
+			return ErrInvalidAudience
+		}
+	}
+	if service.Validation.MaxAge > 0 {
+		if claims.IssuedAt == nil {
+			return fmt.Errorf("%w: iat", ErrMissingClaim)
+		}
+		if time.Since(claims.IssuedAt.Time) > service.Validation.MaxAge+service.Validation.Leeway {
+			return ErrTokenTooOld
+		}
+	}
+	return nil
+}
+
+// claimsError wraps the error of the jwt parser into one of the errors of GetClaims
+func claimsError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return fmt.Errorf("%w: %w", ErrTokenExpired, err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return fmt.Errorf("%w: %w", ErrTokenNotValidYet, err)
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return fmt.Errorf("%w: %w", ErrMissingClaim, err)
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return fmt.Errorf("%w: %w", ErrInvalidIssuer, err)
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidToken, err)
+}
+
+// verificationKey returns the key of the first provider, which knows the kid of the token
+func (service JwtService) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg := token.Method.Alg()
+	var errs []error
+	for _, provider := range service.providers {
+		key, err := provider.VerificationKey(ctx, kid, alg)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKid, kid)
+	}
+	return nil, errors.Join(errs...)
 }
 
 func (service JwtService) GenerateToken(userID int) (string, error) {
+	token, _, err := service.IssueToken(userID, nil)
+	return token, err
+}
+
+// IssueToken generates the token limited by scopes and returns it along with its claims, e.g. to store the jti
+func (service JwtService) IssueToken(userID int, scopes []string) (string, *TokenClaims, error) {
+	return service.issueToken(userID, scopes, false)
+}
+
+// IssueDerivedToken generates the token like IssueToken, which is marked as derived
+func (service JwtService) IssueDerivedToken(userID int, scopes []string) (string, *TokenClaims, error) {
+	return service.issueToken(userID, scopes, true)
+}
+
+func (service JwtService) issueToken(userID int, scopes []string, derived bool) (string, *TokenClaims, error) {
 	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &TokenClaims{
-		UserID: userID,
+	claims := &TokenClaims{
+		UserID:  userID,
+		Scopes:  scopes,
+		Derived: derived,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    service.Validation.Issuer,
+			Audience:  service.Validation.Audience,
 			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(service.TokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 			ID:        uuid.New().String(),
 		},
-	})
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	// Sign token with secret
-	tokenString, err := token.SignedString([]byte(service.codePhrase))
+	if service.keys == nil {
+		return "", nil, ErrNoKeys
+	}
+	// Sign token with the active key
+	kid, key := service.keys.Active()
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	tokenString, err := token.SignedString(key)
 
 	if err != nil {
-		return "", errors.New("could not sign the token")
+		return "", nil, errors.New("could not sign the token")
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
 type ServiceStub struct {
-	GetClaimsStub func(token string) (claims *TokenClaims, err error)
+	GetClaimsStub func(ctx context.Context, token string) (claims *TokenClaims, err error)
 	RealService   Service
 }
 
-func (s ServiceStub) GetClaims(token string) (*TokenClaims, error) {
+func (s ServiceStub) GetClaims(ctx context.Context, token string) (*TokenClaims, error) {
 	if s.GetClaimsStub != nil {
-		return s.GetClaimsStub(token)
+		return s.GetClaimsStub(ctx, token)
 	}
 	if s.RealService != nil {
-		return s.RealService.GetClaims(token)
+		return s.RealService.GetClaims(ctx, token)
 	}
 	panic("both GetClaimsStub or real service are not set")
 }
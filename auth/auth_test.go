@@ -1,9 +1,25 @@
 package auth
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -77,7 +93,7 @@ func TestJwtService_GetClaims(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			got, err := tt.service.GetClaims(tt.args.token)
+			got, err := tt.service.GetClaims(context.Background(), tt.args.token)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("JwtService.GetClaims() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -88,3 +104,299 @@ func TestJwtService_GetClaims(t *testing.T) {
 		})
 	}
 }
+
+func TestJwtService_KeyRotation(t *testing.T) {
+	keys, err := NewKeySet("", map[string][]byte{"2024-01": []byte("old")})
+	assert.Nil(t, err)
+	service := NewJwtServiceWithKeys(keys)
+	service.TokenTTL = 10 * time.Minute
+
+	oldToken, err := service.GenerateToken(1)
+	assert.Nil(t, err)
+
+	err = keys.Replace("", map[string][]byte{"2024-01": []byte("old"), "2024-02": []byte("new")})
+	assert.Nil(t, err)
+	kid, _ := keys.Active()
+	assert.Equal(t, "2024-02", kid)
+
+	newToken, err := service.GenerateToken(2)
+	assert.Nil(t, err)
+
+	claims, err := service.GetClaims(context.Background(), "Bearer "+oldToken)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, claims.UserID)
+	claims, err = service.GetClaims(context.Background(), "Bearer "+newToken)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, claims.UserID)
+
+	err = keys.Replace("", map[string][]byte{"2024-02": []byte("new")})
+	assert.Nil(t, err)
+	_, err = service.GetClaims(context.Background(), "Bearer "+oldToken)
+	assert.ErrorIs(t, err, ErrUnknownKid)
+}
+
+func TestKeySet_Key_WithoutKid(t *testing.T) {
+	keys, err := NewKeySet("", map[string][]byte{"2024-01": []byte("new")})
+	assert.Nil(t, err)
+
+	_, err = keys.Key("")
+	assert.ErrorIs(t, err, ErrUnknownKid)
+
+	keys.SetLegacyKey("phrase")
+	key, err := keys.Key("")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("phrase"), key)
+
+	key, err = NewStaticKeySet("secret").Key("")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), key)
+}
+
+func TestKeySet_Replace_KeepsKeysOnError(t *testing.T) {
+	keys, err := NewKeySet("a", map[string][]byte{"a": []byte("key")})
+	assert.Nil(t, err)
+
+	assert.ErrorIs(t, keys.Replace("b", map[string][]byte{"a": []byte("key")}), ErrUnknownKid)
+	assert.ErrorIs(t, keys.Replace("", nil), ErrNoKeys)
+	kid, key := keys.Active()
+	assert.Equal(t, "a", kid)
+	assert.Equal(t, []byte("key"), key)
+}
+
+func TestFileKeySet_Reload(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key1"), []byte("first\n"), 0o600))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "..data"), 0o700))
+
+	keys, err := NewFileKeySet(dir, "")
+	assert.Nil(t, err)
+	kid, key := keys.Active()
+	assert.Equal(t, "key1", kid)
+	assert.Equal(t, []byte("first"), key)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key2"), []byte("second"), 0o600))
+	assert.Nil(t, keys.Reload())
+	kid, _ = keys.Active()
+	assert.Equal(t, "key2", kid)
+	key, err = keys.Key("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first"), key)
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, userId int) string {
+	token := jwt.NewWithClaims(method, &TokenClaims{
+		UserID: userId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return signed
+}
+
+func TestJwtService_PublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "idp.pem"), rsaPEM, 0o600))
+	publicKeys, err := NewFilePublicKeySet(dir)
+	assert.Nil(t, err)
+
+	service := NewJwtServiceWithKeys(NewStaticKeySet("secret"), publicKeys)
+	service.Algorithms = []string{"HS256", "RS256"}
+
+	claims, err := service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodRS256, "idp", rsaKey, 3))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, claims.UserID)
+
+	// the public key must not be accepted as the HMAC secret
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodHS256, "idp", rsaPEM, 3))
+	assert.NotNil(t, err)
+
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodRS512, "idp", rsaKey, 3))
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, 3))
+	assert.NotNil(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodRS256, "idp", otherKey, 3))
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestJwtService_JWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = fmt.Fprintf(w, `{"keys":[
+			{"kty":"EC","kid":"ec","use":"sig","crv":"P-256","x":%q,"y":%q},
+			{"kty":"OKP","kid":"ed","crv":"Ed25519","x":%q},
+			{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"},
+			{"kty":"oct","kid":"secret","k":"c2VjcmV0"}
+		]}`,
+			base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			base64.RawURLEncoding.EncodeToString(edPublic),
+		)
+	}))
+	defer server.Close()
+
+	jwks, err := NewJWKSSource(context.Background(), server.URL, server.Client())
+	assert.Nil(t, err)
+	service := NewJwtServiceWithKeys(nil, jwks)
+	service.Algorithms = []string{"ES256", "EdDSA"}
+
+	claims, err := service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodES256, "ec", ecKey, 4))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, claims.UserID)
+	claims, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodEdDSA, "ed", edKey, 5))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, claims.UserID)
+
+	// unknown kid doesn't refresh keys more often than MinRefreshInterval
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodES256, "unknown", ecKey, 4))
+	assert.ErrorIs(t, err, ErrUnknownKid)
+	assert.Equal(t, int32(1), requests.Load())
+
+	jwks.MinRefreshInterval = 0
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodES256, "unknown", ecKey, 4))
+	assert.ErrorIs(t, err, ErrUnknownKid)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// hmac tokens are never verified with the jwks, so they don't refresh it
+	service.Algorithms = []string{"ES256", "HS256"}
+	_, err = service.GetClaims(context.Background(), "Bearer "+signToken(t, jwt.SigningMethodHS256, "unknown", []byte("secret"), 4))
+	assert.ErrorIs(t, err, ErrUnknownKid)
+	assert.Equal(t, int32(2), requests.Load())
+
+	_, err = service.GenerateToken(4)
+	assert.ErrorIs(t, err, ErrNoKeys)
+}
+
+func TestJwtService_Validation(t *testing.T) {
+	service := NewJwtService("secret")
+	service.Validation = ValidationOptions{
+		Issuer:     "issuer",
+		Audience:   []string{"database-service", "other-service"},
+		RequireExp: true,
+		MaxAge:     time.Hour,
+		Leeway:     time.Minute,
+	}
+	sign := func(claims jwt.RegisteredClaims) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &TokenClaims{UserID: 1, RegisteredClaims: claims}).
+			SignedString([]byte("secret"))
+		assert.Nil(t, err)
+		return "Bearer " + signed
+	}
+	now := time.Now()
+	valid := jwt.RegisteredClaims{
+		Issuer:    "issuer",
+		Audience:  jwt.ClaimStrings{"database-service"},
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(claims *jwt.RegisteredClaims)
+		wantErr error
+	}{
+		{name: "Valid", modify: func(claims *jwt.RegisteredClaims) {}},
+		{name: "ExpiredWithinLeeway", modify: func(claims *jwt.RegisteredClaims) {
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(-30 * time.Second))
+		}},
+		{name: "Expired", modify: func(claims *jwt.RegisteredClaims) {
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * time.Minute))
+		}, wantErr: ErrTokenExpired},
+		{name: "NoExp", modify: func(claims *jwt.RegisteredClaims) {
+			claims.ExpiresAt = nil
+		}, wantErr: ErrMissingClaim},
+		{name: "NotValidYet", modify: func(claims *jwt.RegisteredClaims) {
+			claims.NotBefore = jwt.NewNumericDate(now.Add(2 * time.Minute))
+		}, wantErr: ErrTokenNotValidYet},
+		{name: "InvalidIssuer", modify: func(claims *jwt.RegisteredClaims) {
+			claims.Issuer = "other"
+		}, wantErr: ErrInvalidIssuer},
+		{name: "OtherAudience", modify: func(claims *jwt.RegisteredClaims) {
+			claims.Audience = jwt.ClaimStrings{"unknown", "other-service"}
+		}},
+		{name: "InvalidAudience", modify: func(claims *jwt.RegisteredClaims) {
+			claims.Audience = jwt.ClaimStrings{"unknown"}
+		}, wantErr: ErrInvalidAudience},
+		{name: "NoAudience", modify: func(claims *jwt.RegisteredClaims) {
+			claims.Audience = nil
+		}, wantErr: ErrMissingClaim},
+		{name: "TooOld", modify: func(claims *jwt.RegisteredClaims) {
+			claims.IssuedAt = jwt.NewNumericDate(now.Add(-2 * time.Hour))
+		}, wantErr: ErrTokenTooOld},
+		{name: "NoIat", modify: func(claims *jwt.RegisteredClaims) {
+			claims.IssuedAt = nil
+		}, wantErr: ErrMissingClaim},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid
+			tt.modify(&claims)
+			_, err := service.GetClaims(context.Background(), sign(claims))
+			if tt.wantErr == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	service.TokenTTL = time.Minute
+	token, err := service.GenerateToken(1)
+	assert.Nil(t, err)
+	_, err = service.GetClaims(context.Background(), "Bearer "+token)
+	assert.Nil(t, err)
+
+	_, err = service.GetClaims(context.Background(), "Token "+token)
+	assert.ErrorIs(t, err, ErrInvalidTokenFormat)
+	_, err = service.GetClaims(context.Background(), "Bearer invalid")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestChainService_GetClaims(t *testing.T) {
+	jwtService := NewJwtService("secret")
+	jwtService.TokenTTL = time.Minute
+	token, err := jwtService.GenerateToken(1)
+	assert.Nil(t, err)
+
+	apiKeyService := ServiceStub{GetClaimsStub: func(ctx context.Context, token string) (*TokenClaims, error) {
+		if token != "ApiKey key" {
+			return nil, ErrInvalidTokenFormat
+		}
+		return &TokenClaims{UserID: 2}, nil
+	}}
+	chain := NewChainService(jwtService, apiKeyService)
+
+	claims, err := chain.GetClaims(context.Background(), "Bearer "+token)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, claims.UserID)
+
+	claims, err = chain.GetClaims(context.Background(), "ApiKey key")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, claims.UserID)
+
+	_, err = chain.GetClaims(context.Background(), "Bearer invalid")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = chain.GetClaims(context.Background(), "Basic user:password")
+	assert.ErrorIs(t, err, ErrInvalidTokenFormat)
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+// ChainService tries each service in order. A service, which doesn't support the scheme of the token,
+// returns ErrInvalidTokenFormat, and the next one is tried
+type ChainService struct {
+	services []Service
+}
+
+func NewChainService(services ...Service) *ChainService {
+	return &ChainService{services: services}
+}
+
+func (chain *ChainService) GetClaims(ctx context.Context, token string) (*TokenClaims, error) {
+	for _, service := range chain.services {
+		claims, err := service.GetClaims(ctx, token)
+		if errors.Is(err, ErrInvalidTokenFormat) {
+			continue
+		}
+		return claims, err
+	}
+	return nil, ErrInvalidTokenFormat
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJWKSMinRefreshInterval limits refreshes of the JWKS triggered by unknown kids
+	DefaultJWKSMinRefreshInterval = 30 * time.Second
+	jwksFetchTimeout              = 5 * time.Second
+	jwksMaxSize                   = 1 << 20
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses the JSON Web Key Set. Keys not used for signatures and unsupported keys are skipped
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if errors.Is(err, ErrUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %q", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: curve %q", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("%w: kty %q", ErrUnsupportedKey, k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWKSSource caches keys of the JWKS fetched by url or read from the file.
+// Keys are refreshed periodically by Watch and on unknown kids, but not more often than MinRefreshInterval
+type JWKSSource struct {
+	*PublicKeySet
+	location           string
+	client             *http.Client
+	MinRefreshInterval time.Duration
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+}
+
+// NewJWKSSource loads keys from the location, which is either http(s) url or file path
+func NewJWKSSource(ctx context.Context, location string, client *http.Client) (*JWKSSource, error) {
+	source := &JWKSSource{
+		PublicKeySet:       NewPublicKeySet(nil),
+		location:           location,
+		client:             client,
+		MinRefreshInterval: DefaultJWKSMinRefreshInterval,
+	}
+	if err := source.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Refresh loads keys again. Current keys are kept on error
+func (s *JWKSSource) Refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	return s.refresh(ctx)
+}
+
+func (s *JWKSSource) refresh(ctx context.Context) error {
+	s.lastRefresh = time.Now()
+	data, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.Replace(keys)
+	return nil
+}
+
+func (s *JWKSSource) load(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(s.location, "http://") && !strings.HasPrefix(s.location, "https://") {
+		return os.ReadFile(s.location)
+	}
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+}
+
+// VerificationKey implements KeyProvider. On unknown kid the keys are refreshed with ctx, if they were not refreshed recently.
+// Tokens signed with HMAC algorithms never trigger the refresh, since the JWKS has no keys for them
+func (s *JWKSSource) VerificationKey(ctx context.Context, kid string, alg string) (interface{}, error) {
+	key, err := s.PublicKeySet.VerificationKey(ctx, kid, alg)
+	if !errors.Is(err, ErrUnknownKid) || !IsAsymmetricAlg(alg) {
+		return key, err
+	}
+	refreshed, refreshErr := s.refreshIfStale(ctx)
+	if refreshErr != nil {
+		return nil, errors.Join(err, refreshErr)
+	}
+	if !refreshed {
+		return nil, err
+	}
+	return s.PublicKeySet.VerificationKey(ctx, kid, alg)
+}
+
+func (s *JWKSSource) refreshIfStale(ctx context.Context) (bool, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if time.Since(s.lastRefresh) < s.MinRefreshInterval {
+		return false, nil
+	}
+	return true, s.refresh(ctx)
+}
+
+// Watch refreshes keys every interval until the context is canceled. Refresh errors are passed to onError
+func (s *JWKSSource) Watch(ctx context.Context, interval time.Duration, onError func(error)) error {
+	return watch(ctx, interval, func() error {
+		if err := s.Refresh(ctx); err != nil {
+			return fmt.Errorf("refresh jwks: %w", err)
+		}
+		return nil
+	}, onError)
+}
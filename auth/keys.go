@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKid = errors.New("unknown key id")
+	ErrNoKeys     = errors.New("no signing keys")
+)
+
+// KeyProvider finds a key to verify the token signed with alg by the key with kid.
+// ctx is the context of the request, providers may use it to fetch keys
+type KeyProvider interface {
+	VerificationKey(ctx context.Context, kid string, alg string) (interface{}, error)
+}
+
+// KeySet holds HMAC keys by their kid. One of them is active and used for signing,
+// all of them are used for verification, so tokens signed with a rotated key stay valid until they expire.
+// Tokens without kid are verified only with the legacy key
+type KeySet struct {
+	mu        sync.RWMutex
+	keys      map[string][]byte
+	activeKid string
+	legacyKey []byte
+}
+
+// NewKeySet creates a key set. If activeKid is empty, the greatest kid in lexical order is active,
+// so keys named by date are rotated by adding a new file
+func NewKeySet(activeKid string, keys map[string][]byte) (*KeySet, error) {
+	set := &KeySet{}
+	if err := set.Replace(activeKid, keys); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// NewStaticKeySet creates a key set of the single key without kid
+func NewStaticKeySet(codePhrase string) *KeySet {
+	return &KeySet{keys: map[string][]byte{"": []byte(codePhrase)}, legacyKey: []byte(codePhrase)}
+}
+
+// SetLegacyKey sets the key of tokens issued without kid, before the rotation was enabled.
+// Such tokens are rejected, if the legacy key is not set
+func (s *KeySet) SetLegacyKey(codePhrase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.legacyKey = []byte(codePhrase)
+}
+
+// Key returns a verification key by kid
+func (s *KeySet) Key(kid string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" {
+		// tokens issued before the rotation have no kid, they must not be verified with whatever key is active now
+		if len(s.legacyKey) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownKid, kid)
+		}
+		return s.legacyKey, nil
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKid, kid)
+	}
+	return key, nil
+}
+
+// VerificationKey implements KeyProvider for HMAC algorithms
+func (s *KeySet) VerificationKey(_ context.Context, kid string, alg string) (interface{}, error) {
+	if !strings.HasPrefix(alg, "HS") {
+		return nil, fmt.Errorf("%w: %q for %s", ErrUnknownKid, kid, alg)
+	}
+	return s.Key(kid)
+}
+
+// Active returns the signing key and its kid
+func (s *KeySet) Active() (kid string, key []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeKid, s.keys[s.activeKid]
+}
+
+// Replace swaps all keys at once. The set is left unchanged on error
+func (s *KeySet) Replace(activeKid string, keys map[string][]byte) error {
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+	if activeKid == "" {
+		kids := make([]string, 0, len(keys))
+		for kid := range keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		activeKid = kids[len(kids)-1]
+	}
+	if _, ok := keys[activeKid]; !ok {
+		return fmt.Errorf("%w: active key %q", ErrUnknownKid, activeKid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.activeKid = activeKid
+	return nil
+}
+
+// LoadKeyDir reads keys from the directory, the name of each file is the kid and the content is the key.
+// Hidden files and directories are skipped, e.g. the ..data links of kubernetes secrets
+func LoadKeyDir(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key = bytes.TrimRight(key, "\r\n")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty key %q", entry.Name())
+		}
+		keys[entry.Name()] = key
+	}
+	return keys, nil
+}
+
+// FileKeySet is a KeySet loaded from the directory and reloaded on change
+type FileKeySet struct {
+	*KeySet
+	dir       string
+	activeKid string
+}
+
+func NewFileKeySet(dir string, activeKid string) (*FileKeySet, error) {
+	keys, err := LoadKeyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	set, err := NewKeySet(activeKid, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeySet{KeySet: set, dir: dir, activeKid: activeKid}, nil
+}
+
+// Reload reads the directory again and replaces the keys. Current keys are kept on error
+func (s *FileKeySet) Reload() error {
+	keys, err := LoadKeyDir(s.dir)
+	if err != nil {
+		return err
+	}
+	return s.Replace(s.activeKid, keys)
+}
+
+// Watch reloads keys every interval until the context is canceled. Reload errors are passed to onError
+func (s *FileKeySet) Watch(ctx context.Context, interval time.Duration, onError func(error)) error {
+	return watch(ctx, interval, func() error {
+		if err := s.Reload(); err != nil {
+			return fmt.Errorf("reload jwt keys: %w", err)
+		}
+		return nil
+	}, onError)
+}
+
+func watch(ctx context.Context, interval time.Duration, reload func() error, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := reload(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key")
+
+// PublicKeySet holds public keys of asymmetric algorithms by their kid
+type PublicKeySet struct {
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+func NewPublicKeySet(keys map[string]crypto.PublicKey) *PublicKeySet {
+	return &PublicKeySet{keys: keys}
+}
+
+// VerificationKey implements KeyProvider for RS*, PS*, ES* and EdDSA algorithms.
+// Tokens without kid are verified with the only key of the set
+func (s *PublicKeySet) VerificationKey(_ context.Context, kid string, alg string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[kid]
+	if !ok && kid == "" && len(s.keys) == 1 {
+		for _, key = range s.keys {
+			ok = true
+		}
+	}
+	if !ok || !keyMatchesAlg(key, alg) {
+		return nil, fmt.Errorf("%w: %q for %s", ErrUnknownKid, kid, alg)
+	}
+	return key, nil
+}
+
+// Replace swaps all keys at once
+func (s *PublicKeySet) Replace(keys map[string]crypto.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func keyMatchesAlg(key crypto.PublicKey, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// IsAsymmetricAlg reports whether tokens signed with alg are verified by public keys
+func IsAsymmetricAlg(alg string) bool {
+	return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS") || strings.HasPrefix(alg, "ES") || alg == "EdDSA"
+}
+
+// ParsePublicKeyPEM parses PKIX or PKCS1 public key or the public key of the certificate
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+	var key crypto.PublicKey
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("%w: pem block %q", ErrUnsupportedKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !keyMatchesAlg(key, "RS256") && !keyMatchesAlg(key, "ES256") && !keyMatchesAlg(key, "EdDSA") {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+	return key, nil
+}
+
+// LoadPublicKeyDir reads pem files from the directory, the name of each file without extension is the kid.
+// Hidden files and directories are skipped
+func LoadPublicKeyDir(dir string) (map[string]crypto.PublicKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		keys[strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))] = key
+	}
+	return keys, nil
+}
+
+// FilePublicKeySet is a PublicKeySet loaded from the directory of pem files and reloaded on change
+type FilePublicKeySet struct {
+	*PublicKeySet
+	dir string
+}
+
+func NewFilePublicKeySet(dir string) (*FilePublicKeySet, error) {
+	keys, err := LoadPublicKeyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublicKeySet{PublicKeySet: NewPublicKeySet(keys), dir: dir}, nil
+}
+
+// Reload reads the directory again and replaces the keys. Current keys are kept on error
+func (s *FilePublicKeySet) Reload() error {
+	keys, err := LoadPublicKeyDir(s.dir)
+	if err != nil {
+		return err
+	}
+	s.Replace(keys)
+	return nil
+}
+
+// Watch reloads keys every interval until the context is canceled. Reload errors are passed to onError
+func (s *FilePublicKeySet) Watch(ctx context.Context, interval time.Duration, onError func(error)) error {
+	return watch(ctx, interval, func() error {
+		if err := s.Reload(); err != nil {
+			return fmt.Errorf("reload jwt public keys: %w", err)
+		}
+		return nil
+	}, onError)
+}
@@ -4,30 +4,61 @@ import (
 	"context"
 	"errors"
 	"github.com/go-redis/cache/v9"
+	"github.com/redis/go-redis/v9"
+	"strings"
 	"time"
 )
 
+const scanCount = 1000
+
 type Cache interface {
 	Set(ctx context.Context, key string, value interface{}) error
+	// SetWithTTL sets value with ttl different from the default one. Local caches keep entries for the default ttl,
+	// so entries with a shorter ttl are not put to the local cache on write. A read still puts them there,
+	// so callers check the age of such entries themselves
+	SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error
 	Get(ctx context.Context, key string, dest interface{}) error
+	Delete(ctx context.Context, keys ...string) error
+	// InvalidatePrefix deletes all keys, which start with prefix
+	InvalidatePrefix(ctx context.Context, prefix string) error
 }
 
 type Adapter struct {
-	cache *cache.Cache
-	ttl   time.Duration
+	cache       *cache.Cache
+	redis       *redis.Client
+	ttl         time.Duration
+	invalidator *LocalInvalidator
+}
+
+func NewCacheAdapter(ttl time.Duration, cache *cache.Cache, redis *redis.Client) Cache {
+	return &Adapter{ttl: ttl, cache: cache, redis: redis}
 }
 
-func NewCacheAdapter(ttl time.Duration, cache *cache.Cache) Cache {
-	return &Adapter{ttl: ttl, cache: cache}
+// NewInvalidatingCacheAdapter returns adapter, which notifies other instances to drop changed keys from their local caches
+func NewInvalidatingCacheAdapter(ttl time.Duration, cache *cache.Cache, redis *redis.Client, invalidator *LocalInvalidator) Cache {
+	return &Adapter{ttl: ttl, cache: cache, redis: redis, invalidator: invalidator}
 }
 
 func (adapter *Adapter) Set(ctx context.Context, key string, value interface{}) error {
-	return adapter.cache.Set(&cache.Item{
+	return adapter.SetWithTTL(ctx, key, value, adapter.ttl)
+}
+
+func (adapter *Adapter) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	err := adapter.cache.Set(&cache.Item{
 		Ctx:   ctx,
 		Key:   key,
 		Value: value,
-		TTL:   adapter.ttl,
+		TTL:   ttl,
+		// the local cache has the fixed default ttl and would keep the entry longer
+		SkipLocalCache: ttl < adapter.ttl,
 	})
+	if err != nil {
+		return err
+	}
+	if adapter.invalidator != nil {
+		adapter.invalidator.notify(ctx, key)
+	}
+	return nil
 }
 
 func (adapter *Adapter) Get(ctx context.Context, key string, dest interface{}) error {
@@ -41,10 +72,56 @@ func (adapter *Adapter) Get(ctx context.Context, key string, dest interface{}) e
 	return nil
 }
 
+func (adapter *Adapter) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		err := adapter.cache.Delete(ctx, key)
+		if err != nil && !errors.Is(err, cache.ErrCacheMiss) {
+			return err
+		}
+	}
+	if adapter.invalidator != nil && len(keys) > 0 {
+		adapter.invalidator.notify(ctx, keys...)
+	}
+	return nil
+}
+
+func (adapter *Adapter) InvalidatePrefix(ctx context.Context, prefix string) error {
+	iter := adapter.redis.Scan(ctx, 0, escapePattern(prefix)+"*", scanCount).Iterator()
+	keys := make([]string, 0, scanCount)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == scanCount {
+			if err := adapter.Delete(ctx, keys...); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return adapter.Delete(ctx, keys...)
+}
+
+// escapePattern escapes special characters of the redis glob-style pattern
+func escapePattern(s string) string {
+	var builder strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]^\`, r) {
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
 type Stub struct {
-	SetStub     func(ctx context.Context, key string, value interface{}) error
-	GetStub     func(ctx context.Context, key string, dest interface{}) error
-	RealAdapter Cache
+	SetStub              func(ctx context.Context, key string, value interface{}) error
+	SetWithTTLStub       func(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	GetStub              func(ctx context.Context, key string, dest interface{}) error
+	DeleteStub           func(ctx context.Context, keys ...string) error
+	InvalidatePrefixStub func(ctx context.Context, prefix string) error
+	RealAdapter          Cache
 }
 
 func (cs Stub) Set(ctx context.Context, key string, value interface{}) error {
@@ -57,6 +134,16 @@ func (cs Stub) Set(ctx context.Context, key string, value interface{}) error {
 	panic("No real adapter or stub defined for Set")
 }
 
+func (cs Stub) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if cs.SetWithTTLStub != nil {
+		return cs.SetWithTTLStub(ctx, key, value, ttl)
+	}
+	if cs.RealAdapter != nil {
+		return cs.RealAdapter.SetWithTTL(ctx, key, value, ttl)
+	}
+	panic("No real adapter or stub defined for SetWithTTL")
+}
+
 func (cs Stub) Get(ctx context.Context, key string, dest interface{}) error {
 	if cs.GetStub != nil {
 		return cs.GetStub(ctx, key, dest)
@@ -66,3 +153,23 @@ func (cs Stub) Get(ctx context.Context, key string, dest interface{}) error {
 	}
 	panic("No real adapter or stub defined for Get")
 }
+
+func (cs Stub) Delete(ctx context.Context, keys ...string) error {
+	if cs.DeleteStub != nil {
+		return cs.DeleteStub(ctx, keys...)
+	}
+	if cs.RealAdapter != nil {
+		return cs.RealAdapter.Delete(ctx, keys...)
+	}
+	panic("No real adapter or stub defined for Delete")
+}
+
+func (cs Stub) InvalidatePrefix(ctx context.Context, prefix string) error {
+	if cs.InvalidatePrefixStub != nil {
+		return cs.InvalidatePrefixStub(ctx, prefix)
+	}
+	if cs.RealAdapter != nil {
+		return cs.RealAdapter.InvalidatePrefix(ctx, prefix)
+	}
+	panic("No real adapter or stub defined for InvalidatePrefix")
+}
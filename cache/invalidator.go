@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"database-service/dbservice/api/logger"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/cache/v9"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+const (
+	subscribeMinRetry = time.Second
+	subscribeMaxRetry = 30 * time.Second
+)
+
+// ResettableLocalCache is a local cache, which can be dropped as a whole. Invalidations are not delivered while
+// the invalidator is not subscribed, so it drops the local cache on every subscription
+type ResettableLocalCache struct {
+	mu    sync.RWMutex
+	local *cache.TinyLFU
+	size  int
+	ttl   time.Duration
+}
+
+var _ cache.LocalCache = (*ResettableLocalCache)(nil)
+
+func NewResettableLocalCache(size int, ttl time.Duration) *ResettableLocalCache {
+	return &ResettableLocalCache{local: cache.NewTinyLFU(size, ttl), size: size, ttl: ttl}
+}
+
+func (c *ResettableLocalCache) Set(key string, data []byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.local.Set(key, data)
+}
+
+func (c *ResettableLocalCache) Get(key string) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.local.Get(key)
+}
+
+func (c *ResettableLocalCache) Del(key string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.local.Del(key)
+}
+
+// Reset drops all keys
+func (c *ResettableLocalCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.local = cache.NewTinyLFU(c.size, c.ttl)
+}
+
+// LocalInvalidator drops keys from local caches of all instances, which share the same redis
+type LocalInvalidator struct {
+	redis          *redis.Client
+	local          *ResettableLocalCache
+	channel        string
+	instanceId     string
+	logger         logger.Logger
+	publishErrorsM prometheus.Counter
+}
+
+type invalidationMessage struct {
+	InstanceId string   `json:"instance_id"`
+	Keys       []string `json:"keys"`
+}
+
+// NewLocalInvalidator creates the invalidator of local, which must be the local cache of the instance
+func NewLocalInvalidator(redis *redis.Client, local *ResettableLocalCache, channel string, logger logger.Logger) *LocalInvalidator {
+	return &LocalInvalidator{
+		redis:      redis,
+		local:      local,
+		channel:    channel,
+		instanceId: uuid.New().String(),
+		logger:     logger,
+		publishErrorsM: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "database_service_cache_invalidation_publish_errors_total",
+			Help: "database-service failed notifications of other instances about changed keys",
+		}),
+	}
+}
+
+// Collectors returns metrics of the invalidator to be registered
+func (i *LocalInvalidator) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{i.publishErrorsM}
+}
+
+// Publish notifies other instances that keys are changed
+func (i *LocalInvalidator) Publish(ctx context.Context, keys ...string) error {
+	message, err := json.Marshal(invalidationMessage{InstanceId: i.instanceId, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return i.redis.Publish(ctx, i.channel, message).Err()
+}
+
+// notify publishes keys after they are written to redis. The write has already succeeded, so the failure is only
+// logged and counted: other instances keep stale keys in their local caches until the local ttl
+func (i *LocalInvalidator) notify(ctx context.Context, keys ...string) {
+	if err := i.Publish(ctx, keys...); err != nil {
+		i.publishErrorsM.Inc()
+		i.logger.Error(fmt.Errorf("publish cache invalidation: %w", err))
+	}
+}
+
+// Run drops keys published by other instances from the local cache until ctx is done. Failed subscriptions are
+// retried with backoff. Messages published while the invalidator is not subscribed are lost,
+// so the local cache is dropped on every subscription, including resubscriptions after reconnects to redis
+func (i *LocalInvalidator) Run(ctx context.Context) error {
+	retry := subscribeMinRetry
+	for {
+		if err := i.subscribe(ctx); err != nil {
+			i.logger.Error(fmt.Errorf("subscribe to cache invalidations: %w", err))
+		} else {
+			retry = subscribeMinRetry
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, subscribeMaxRetry)
+	}
+}
+
+// subscribe handles messages until ctx is done or the subscription is closed
+func (i *LocalInvalidator) subscribe(ctx context.Context) error {
+	pubSub := i.redis.Subscribe(ctx, i.channel)
+	defer pubSub.Close()
+
+	if _, err := pubSub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	i.local.Reset()
+
+	messages := pubSub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				// resubscribed after a reconnect
+				i.local.Reset()
+			case *redis.Message:
+				i.drop(msg)
+			}
+		}
+	}
+}
+
+func (i *LocalInvalidator) drop(msg *redis.Message) {
+	var message invalidationMessage
+	if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+		return
+	}
+	// own changes are already in the local cache
+	if message.InstanceId == i.instanceId {
+		return
+	}
+	for _, key := range message.Keys {
+		i.local.Del(key)
+	}
+}
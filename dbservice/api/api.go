@@ -10,20 +10,34 @@ import (
 	"database-service/dbservice/api/services"
 	"database-service/domain"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	cachepkg "github.com/go-redis/cache/v9"
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const MetricPath = "/metrics"
 
+// ReadHeaderTimeout limits the time of reading request headers, so slow clients don't hold connections
+const ReadHeaderTimeout = 10 * time.Second
+
+// UnmatchedRoute is a route label of requests, which match no route, so unknown paths don't create new series
+const UnmatchedRoute = "unmatched"
+
 type Api struct {
 	config     *config.Values
 	router     *gin.Engine
@@ -32,9 +46,19 @@ type Api struct {
 	logger     logger.Logger
 	metricsReg *prometheus.Registry
 	requestsM  *prometheus.HistogramVec
+	// ready is false until the server is started and after the shutdown is begun
+	ready atomic.Bool
+	// background is a context of the background workers, it is canceled on shutdown
+	background     context.Context
+	stopBackground context.CancelFunc
+	// backgroundWg waits for the background workers to stop before connections are closed
+	backgroundWg sync.WaitGroup
 }
 
-func NewApi() (api Api, err error) {
+func NewApi() (api *Api, err error) {
+	api = &Api{}
+	api.background, api.stopBackground = context.WithCancel(context.Background())
+
 	api.config, err = config.ReadConfig()
 	if err != nil {
 		return
@@ -58,7 +82,10 @@ func NewApi() (api Api, err error) {
 
 	api.initMiddleware()
 
-	api.InitRoutes()
+	if err = api.InitRoutes(); err != nil {
+		api.logger.Error(err)
+		return
+	}
 
 	return api, nil
 
@@ -85,60 +112,315 @@ func (api *Api) initMetrics() (err error) {
 		Help:    "database-service requests duration seconds",
 		Buckets: []float64{0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10},
 	}, []string{"route", "status_code"})
-	return api.metricsReg.Register(api.requestsM)
+	return errors.Join(
+		api.metricsReg.Register(api.requestsM),
+		api.metricsReg.Register(collectors.NewDBStatsCollector(api.db, "database_service")),
+		api.metricsReg.Register(NewRedisPoolStatsCollector(api.redis)),
+	)
 }
 
 func (api *Api) initMiddleware() {
 	api.router.Use(api.GetMetricsHandler())
+	if timeout := api.config.GetRequestTimeout(); timeout > 0 {
+		api.router.Use(GetTimeoutHandler(timeout))
+	}
 }
 
-func (api *Api) Run() {
-	err := api.router.Run()
+// Run serves requests until SIGINT or SIGTERM is received, then gracefully shuts down the api:
+// marks it as not ready, drains connections within the grace period and closes db and redis connections
+func (api *Api) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// the port is bound before the api is marked as ready
+	listener, err := net.Listen("tcp", api.config.GetAddr())
 	if err != nil {
-		panic(err)
+		return errors.Join(err, api.Close())
 	}
+	server := &http.Server{Handler: api.router, ReadHeaderTimeout: ReadHeaderTimeout}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+	api.ready.Store(true)
+
+	select {
+	case err := <-serverErr:
+		api.ready.Store(false)
+		return errors.Join(err, api.Close())
+	case <-ctx.Done():
+	}
+
+	api.logger.Info("shutting down")
+	api.ready.Store(false)
+	time.Sleep(api.config.GetShutdownDelay())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), api.config.GetShutdownGracePeriod())
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	return errors.Join(err, api.Close())
+}
+
+// IsReady reports whether the api accepts requests
+func (api *Api) IsReady() bool {
+	return api.ready.Load()
+}
+
+// Close stops background workers, waits for them and for queries of the cache, which outlive requests,
+// and closes db and redis connections
+func (api *Api) Close() error {
+	api.stopBackground()
+	api.backgroundWg.Wait()
+	return errors.Join(api.db.Close(), api.redis.Close())
+}
+
+// runBackground runs fn in a goroutine until the api is closed
+func (api *Api) runBackground(fn func(ctx context.Context) error) {
+	api.backgroundWg.Add(1)
+	go func() {
+		defer api.backgroundWg.Done()
+		if err := fn(api.background); err != nil {
+			api.logger.Error(err)
+		}
+	}()
 }
 
-func (api *Api) InitRoutes() {
+// runPeriodic runs fn every interval until the api is closed, errors are logged
+func (api *Api) runPeriodic(interval time.Duration, fn func(ctx context.Context) error) {
+	api.runBackground(func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := fn(ctx); err != nil {
+					api.logger.Error(err)
+				}
+			}
+		}
+	})
+}
+
+func (api *Api) InitRoutes() error {
+	localCache := cache.NewResettableLocalCache(1000, api.config.GetCacheTTL())
 	cacheClient := cachepkg.New(&cachepkg.Options{
 		Redis:      api.redis,
-		LocalCache: cachepkg.NewTinyLFU(1000, api.config.GetCacheTTL()),
+		LocalCache: localCache,
 	})
-	cacheAdapter := cache.NewCacheAdapter(api.config.GetCacheTTL(), cacheClient)
+	invalidator := cache.NewLocalInvalidator(api.redis, localCache, api.config.GetInvalidationChannel(), api.logger)
+	for _, collector := range invalidator.Collectors() {
+		if err := api.metricsReg.Register(collector); err != nil {
+			api.logger.Error(err)
+		}
+	}
+	api.runBackground(invalidator.Run)
+	cacheAdapter := cache.NewInvalidatingCacheAdapter(api.config.GetCacheTTL(), cacheClient, api.redis, invalidator)
 	dbDataRepo := domain.NewDbDataRepository(api.db)
-	cachedRepo := domain.NewCachedDataRepository(dbDataRepo, cacheAdapter, api.config.Cache.KeyPrefix)
-	usersRepo := domain.NewUserRepository(api.db, api.logger)
-	authService := auth.NewJwtService(api.config.JwtCodePhrase)
+	cachedRepo := domain.NewCachedDataRepository(dbDataRepo, cacheAdapter, api.config.Cache.KeyPrefix, api.logger, domain.CacheOptions{
+		SoftTTL:    api.config.GetCacheSoftTTL(),
+		EmptyTTL:   api.config.GetCacheEmptyTTL(),
+		FailClosed: api.config.IsCacheFailClosed(),
+		Background: &api.backgroundWg,
+	})
+	for _, collector := range cachedRepo.Collectors() {
+		if err := api.metricsReg.Register(collector); err != nil {
+			api.logger.Error(err)
+		}
+	}
+	usersRepo := domain.NewUserRepository(api.db)
+	var usersInvalidator UsersCacheInvalidator
+	if ttl := api.config.GetCacheUsersTTL(); ttl > 0 {
+		cachedUsersRepo := domain.NewCachedUserRepository(usersRepo, cacheAdapter, api.config.Cache.KeyPrefix, ttl, api.logger)
+		usersRepo, usersInvalidator = cachedUsersRepo, cachedUsersRepo
+	}
+	authService, err := api.newJwtService()
+	if err != nil {
+		return err
+	}
+	authService.TokenTTL = api.config.GetAccessTokenTTL()
+	revocationRepo := api.newRevocationRepository()
+	revocationService := services.NewRevocationService(revocationRepo, usersRepo,
+		api.config.GetRevocationCacheTTL(), api.config.GetRevocationTTL())
+	authService.Revocations = revocationService
+	refreshRepo := domain.NewDbRefreshTokenRepository(api.db)
+	api.runPeriodic(CleanupInterval, refreshRepo.DeleteExpired)
+	tokenService := services.NewTokenService(authService, refreshRepo, revocationRepo, usersRepo, api.config.GetRefreshTokenTTL())
+	apiKeyService := services.NewApiKeyService(domain.NewDbApiKeyRepository(api.db), usersRepo, revocationService, api.logger)
+	chainService := api.newChainService(authService, apiKeyService)
 	dataService := services.NewDataService(cachedRepo, usersRepo)
+	userService := services.NewUserService(domain.NewDbUserManagementRepository(api.db), usersRepo, revocationService,
+		cachedRepo, usersInvalidator, api.logger)
 
-	dataController := controller.NewDataController(authService, dataService, api.logger)
+	dataController := controller.NewDataController(chainService, dataService, api.logger)
+	authController := controller.NewAuthController(chainService, revocationService, tokenService, apiKeyService, api.logger)
+	userController := controller.NewUserController(chainService, userService, api.logger)
 
 	dataController.AddRoutes(api.router)
+	authController.AddRoutes(api.router)
+	userController.AddRoutes(api.router)
+
+	api.runNotifyListener(cachedRepo, usersInvalidator)
+
+	healthController := controller.NewHealthController(
+		controller.PingerFunc(api.db.PingContext),
+		controller.PingerFunc(func(ctx context.Context) error {
+			return api.redis.Ping(ctx).Err()
+		}),
+		api.IsReady,
+		api.config.GetHealthTimeout(),
+		api.config.IsCacheFailClosed(),
+		api.logger,
+	)
+	healthController.AddRoutes(api.router)
 
 	api.router.GET(MetricPath, gin.WrapH(promhttp.HandlerFor(api.metricsReg, promhttp.HandlerOpts{})))
+	return nil
+}
+
+// newJwtService creates the service with keys from Jwt.KeysDir or with the single JwtCodePhrase,
+// and with public keys of Jwt.PublicKeysDir and Jwt.JWKS. Keys are reloaded in background
+func (api *Api) newJwtService() (*auth.JwtService, error) {
+	var keys *auth.KeySet
+	var providers []auth.KeyProvider
+	onError := func(err error) {
+		api.logger.Error(err)
+	}
+
+	switch {
+	case api.config.Jwt.KeysDir != "":
+		fileKeys, err := auth.NewFileKeySet(api.config.Jwt.KeysDir, api.config.Jwt.ActiveKid)
+		if err != nil {
+			return nil, err
+		}
+		api.runBackground(func(ctx context.Context) error {
+			return fileKeys.Watch(ctx, api.config.GetJwtReloadInterval(), onError)
+		})
+		keys = fileKeys.KeySet
+		if api.config.JwtCodePhrase != "" {
+			keys.SetLegacyKey(api.config.JwtCodePhrase)
+		}
+	case api.config.JwtCodePhrase != "":
+		keys = auth.NewStaticKeySet(api.config.JwtCodePhrase)
+	}
+
+	if api.config.Jwt.PublicKeysDir != "" {
+		publicKeys, err := auth.NewFilePublicKeySet(api.config.Jwt.PublicKeysDir)
+		if err != nil {
+			return nil, err
+		}
+		api.runBackground(func(ctx context.Context) error {
+			return publicKeys.Watch(ctx, api.config.GetJwtReloadInterval(), onError)
+		})
+		providers = append(providers, publicKeys)
+	}
+	if api.config.Jwt.JWKS != "" {
+		jwks, err := auth.NewJWKSSource(api.background, api.config.Jwt.JWKS, http.DefaultClient)
+		if err != nil {
+			return nil, err
+		}
+		api.runBackground(func(ctx context.Context) error {
+			return jwks.Watch(ctx, api.config.GetJWKSRefreshInterval(), onError)
+		})
+		providers = append(providers, jwks)
+	}
+
+	service := auth.NewJwtServiceWithKeys(keys, providers...)
+	service.Algorithms = api.config.Jwt.Algorithms
+	service.Validation = auth.ValidationOptions{
+		Issuer:     api.config.Jwt.Issuer,
+		Audience:   api.config.Jwt.Audience,
+		RequireExp: api.config.Jwt.RequireExp,
+		MaxAge:     api.config.GetJwtMaxAge(),
+		Leeway:     api.config.GetJwtLeeway(),
+	}
+	return service, nil
+}
+
+// newChainService combines services of Auth.Schemes in the configured order
+func (api *Api) newChainService(jwtService auth.Service, apiKeyService auth.Service) *auth.ChainService {
+	schemes := map[string]auth.Service{
+		config.AuthSchemeJwt:    jwtService,
+		config.AuthSchemeApiKey: apiKeyService,
+	}
+	authServices := make([]auth.Service, 0, len(api.config.Auth.Schemes))
+	for _, scheme := range api.config.Auth.Schemes {
+		authServices = append(authServices, schemes[scheme])
+	}
+	return auth.NewChainService(authServices...)
+}
+
+// CleanupInterval is an interval of removing revocations and refresh tokens of expired tokens from db
+const CleanupInterval = time.Hour
+
+// RevocationSyncInterval is an interval of checking, whether redis has lost revocations, and copying them again
+const RevocationSyncInterval = 10 * time.Second
+
+// newRevocationRepository creates the redis revocation list with db fallback. Revocations are copied from db to redis
+// on start. If redis loses them, reads fall back to db, until they are copied again within RevocationSyncInterval
+func (api *Api) newRevocationRepository() domain.IRevocationRepository {
+	dbRepo := domain.NewDbRevocationRepository(api.db)
+	redisRepo := domain.NewRedisRevocationRepository(api.redis, api.config.Cache.KeyPrefix)
+	syncRevocations := func(ctx context.Context) error {
+		if err := dbRepo.SyncTo(ctx, redisRepo); err != nil {
+			return fmt.Errorf("copy revocations to redis: %w", err)
+		}
+		return nil
+	}
+	api.runBackground(syncRevocations)
+	api.runPeriodic(RevocationSyncInterval, syncRevocations)
+	api.runPeriodic(CleanupInterval, dbRepo.DeleteExpired)
+	return domain.NewFallbackRevocationRepository(redisRepo, dbRepo, api.logger)
+}
+
+func (api *Api) runNotifyListener(invalidator CacheInvalidator, usersInvalidator UsersCacheInvalidator) {
+	listener := NewNotifyListener(api.config.GetDSN(), invalidator, usersInvalidator, api.logger)
+	api.runBackground(listener.Run)
 }
 
 func (api *Api) GetMetricsHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.URL.Path == MetricPath {
+		switch c.Request.URL.Path {
+		case MetricPath, controller.LivenessPath, controller.ReadinessPath:
 			c.Next()
 			return
 		}
 		startTime := time.Now().UTC()
 		c.Next()
 		dur := time.Now().UTC().Sub(startTime)
-		route := fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path)
+		// the route template is used instead of the path, so ids don't create new series
+		path := c.FullPath()
+		if path == "" {
+			path = UnmatchedRoute
+		}
+		route := fmt.Sprintf("%s %s", c.Request.Method, path)
 		status := strconv.Itoa(c.Writer.Status())
 		api.requestsM.WithLabelValues(route, status).Observe(dur.Seconds())
 	}
 }
 
+// GetTimeoutHandler sets the deadline to the request context, which is passed down to db and cache queries
+func GetTimeoutHandler(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
 func NewDB(config *config.Values) (*sql.DB, error) {
 	db, err := sql.Open("postgres", config.GetDSN())
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(config.GetDBMaxOpenConns())
+	if config.DB.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(config.DB.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.GetDBConnMaxLifetime())
+	db.SetConnMaxIdleTime(config.GetDBConnMaxIdleTime())
 	timeout, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelFunc()
 
@@ -156,10 +438,15 @@ func NewDB(config *config.Values) (*sql.DB, error) {
 
 func NewRedis(config *config.Values) (*redis.Client, error) {
 	rcl := redis.NewClient(&redis.Options{
-		Addr:     config.Redis.Addr,
-		Password: config.Redis.Password,
-		Username: config.Redis.Username,
-		DB:       config.Redis.Db,
+		Addr:         config.Redis.Addr,
+		Password:     config.Redis.Password,
+		Username:     config.Redis.Username,
+		DB:           config.Redis.Db,
+		PoolSize:     config.Redis.PoolSize,
+		MinIdleConns: config.Redis.MinIdleConns,
+		ReadTimeout:  config.GetRedisReadTimeout(),
+		WriteTimeout: config.GetRedisWriteTimeout(),
+		MaxRetries:   config.Redis.MaxRetries,
 	})
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelFunc()
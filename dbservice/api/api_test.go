@@ -13,14 +13,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gin-gonic/gin"
 	cachepkg "github.com/go-redis/cache/v9"
+	"github.com/lib/pq"
 	"github.com/pressly/goose/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -57,6 +66,7 @@ type Suite struct {
 	authServiceStub    auth.ServiceStub
 	authService        *auth.JwtService
 	dataServiceStub    services.FakeDataService
+	cacheOptions       domain.CacheOptions
 	// dynamic data
 	token            string
 	user             testUser
@@ -72,6 +82,65 @@ func TestDataControllerSuite(t *testing.T) {
 	suite.Run(t, new(Suite))
 }
 
+func TestApi_Close_WaitsForCacheRevalidation(t *testing.T) {
+	db, err := sql.Open("postgres", "postgres://127.0.0.1:1/database_service?sslmode=disable")
+	assert.Nil(t, err)
+	api := &Api{db: db, redis: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"}), logger: logger.Stub{}}
+	api.background, api.stopBackground = context.WithCancel(context.Background())
+
+	var revalidated atomic.Bool
+	repo := domain.NewCachedDataRepository(domain.DataRepositoryStub{
+		GetDataByUserStub: func(ctx context.Context, userId int) ([]domain.Data, error) {
+			time.Sleep(200 * time.Millisecond)
+			revalidated.Store(true)
+			return nil, nil
+		},
+	}, cache.Stub{
+		GetStub: func(ctx context.Context, key string, dest interface{}) error {
+			*dest.(*domain.CacheList) = domain.CacheList{
+				Data:     []domain.CacheData{{Id: 1, UserId: 1, Data: "stale"}},
+				StoredAt: time.Now().Add(-time.Minute).UnixNano(),
+			}
+			return nil
+		},
+		SetStub: func(ctx context.Context, key string, value interface{}) error {
+			return nil
+		},
+	}, TestsKeyPrefix, logger.Stub{}, domain.CacheOptions{SoftTTL: time.Second, Background: &api.backgroundWg})
+
+	// the stale list is returned at once, and the revalidation outlives the request
+	data, err := repo.GetDataByUser(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Len(t, data, 1)
+	assert.False(t, revalidated.Load())
+
+	assert.Nil(t, api.Close())
+	assert.True(t, revalidated.Load())
+}
+
+func TestGetMetricsHandler_RouteLabel(t *testing.T) {
+	api := &Api{requestsM: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_requests"}, []string{"route", "status_code"})}
+	router := gin.New()
+	router.Use(api.GetMetricsHandler())
+	router.GET("/data/:id", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, path := range []string{"/data/1", "/data/2", "/unknown/1", "/unknown/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2, testutil.CollectAndCount(api.requestsM))
+	assert.Equal(t, uint64(2), histogramCount(t, api.requestsM.WithLabelValues("GET /data/:id", "200")))
+	assert.Equal(t, uint64(2), histogramCount(t, api.requestsM.WithLabelValues("GET "+UnmatchedRoute, "404")))
+}
+
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	assert.Nil(t, observer.(prometheus.Metric).Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
 func (suite *Suite) SetupSuite() {
 	os.Setenv("TZ", "UTC")
 
@@ -106,7 +175,7 @@ func (suite *Suite) reload() {
 	}
 
 	suite.cacheStub = cache.Stub{
-		RealAdapter: cache.NewCacheAdapter(10*time.Second, suite.cache),
+		RealAdapter: cache.NewCacheAdapter(10*time.Second, suite.cache, suite.redis),
 	}
 
 	suite.dbDataRepoStub = domain.DataRepositoryStub{
@@ -121,10 +190,15 @@ func (suite *Suite) reload() {
 	}
 
 	suite.usersRepoStub = domain.UserRepositoryStub{
-		IsAdminStub: nil,
-		RealAdapter: domain.NewUserRepository(suite.db, suite.loggerStub),
+		GetAccessLevelStub: nil,
+		GetPermissionsStub: nil,
+		RealAdapter:        domain.NewUserRepository(suite.db),
 	}
 
+	suite.cacheOptions = domain.CacheOptions{}
+
+	suite.authService.Revocations = nil
+
 	suite.authServiceStub = auth.ServiceStub{
 		GetClaimsStub: nil,
 		RealService:   suite.authService,
@@ -182,7 +256,7 @@ func (suite *Suite) build() *controller.DataController {
 
 	suite.token, _ = suite.authService.GenerateToken(suite.user.Id)
 
-	suite.cachedDataRepoStub.RealAdapter = domain.NewCachedDataRepository(suite.dbDataRepoStub, &suite.cacheStub, TestsKeyPrefix)
+	suite.cachedDataRepoStub.RealAdapter = domain.NewCachedDataRepository(suite.dbDataRepoStub, &suite.cacheStub, TestsKeyPrefix, suite.loggerStub, suite.cacheOptions)
 
 	suite.dataServiceStub.Service = services.NewDataService(suite.cachedDataRepoStub, suite.usersRepoStub)
 
@@ -200,6 +274,11 @@ func (suite *Suite) truncateDb() {
 		panic(err)
 	}
 	tx.Exec("DELETE FROM data")
+	tx.Exec("DELETE FROM revoked_tokens")
+	tx.Exec("DELETE FROM user_token_revocations")
+	tx.Exec("DELETE FROM refresh_tokens")
+	tx.Exec("DELETE FROM api_keys")
+	tx.Exec("DELETE FROM user_roles")
 	tx.Exec("DELETE FROM users")
 
 	err = tx.Commit()
@@ -213,7 +292,7 @@ func (suite *Suite) truncateRedis() {
 }
 
 func (suite *Suite) Test_GetData_Success() {
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
@@ -223,11 +302,11 @@ func (suite *Suite) Test_GetData_Success() {
 }
 
 func (suite *Suite) Test_GetData_GetClaims_Error() {
-	suite.authServiceStub.GetClaimsStub = func(token string) (claims *auth.TokenClaims, err error) {
+	suite.authServiceStub.GetClaimsStub = func(ctx context.Context, token string) (claims *auth.TokenClaims, err error) {
 		return nil, errors.New("cannot get claims")
 	}
 
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
@@ -235,38 +314,41 @@ func (suite *Suite) Test_GetData_GetClaims_Error() {
 }
 
 func (suite *Suite) Test_GetData_DataService_Error() {
-	suite.dataServiceStub.GetDataByAccessLevelStub = func(userId int) ([]domain.Data, error) {
+	suite.dataServiceStub.GetDataByAccessLevelStub = func(ctx context.Context, claims *auth.TokenClaims) ([]domain.Data, error) {
 		return nil, errors.New("cannot get data")
 	}
 	suite.loggerStub.ErrorStub = func(args ...interface{}) {
 		assert.Contains(suite.T(), args[0].(error).Error(), "cannot get data")
 
 	}
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	assert.Equal(suite.T(), http.StatusInternalServerError, response.Status)
 }
 
 func (suite *Suite) Test_GetData_ByUser_FromCache() {
-	var dataFromCache = []domain.CacheData{
-		{
-			Id:     1,
-			UserId: 1,
-			Data:   "message_1",
-		},
-		{
-			Id:     2,
-			UserId: 1,
-			Data:   "message_2",
+	var dataFromCache = domain.CacheList{
+		Data: []domain.CacheData{
+			{
+				Id:     1,
+				UserId: 1,
+				Data:   "message_1",
+			},
+			{
+				Id:     2,
+				UserId: 1,
+				Data:   "message_2",
+			},
 		},
+		StoredAt: time.Now().UnixNano(),
 	}
 	marshal, err := suite.cache.Marshal(&dataFromCache)
 	if err != nil {
 		return
 	}
 
-	suite.redis.Set(context.Background(), "cache_1", marshal, 0)
-	response := suite.build().GetData(suite.getToken())
+	suite.redis.Set(context.Background(), "cache_data_1", marshal, 0)
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
@@ -284,7 +366,7 @@ func (suite *Suite) Test_GetData_ByUser_FromCache_Error() {
 	suite.cacheStub.GetStub = func(ctx context.Context, key string, dest interface{}) error {
 		return errors.New("cannot get data")
 	}
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
@@ -297,7 +379,7 @@ func (suite *Suite) Test_GetData_ByUser_FromDb() {
 	suite.cacheStub.GetStub = func(ctx context.Context, key string, dest interface{}) error {
 		return errors.New("cannot get data")
 	}
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
@@ -308,15 +390,16 @@ func (suite *Suite) Test_GetData_ByUser_FromDb() {
 
 func (suite *Suite) Test_GetData_ByUser_FromDb_SetToCache() {
 
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
 
-	r := suite.redis.Get(context.Background(), "cache_1")
+	r := suite.redis.Get(context.Background(), "cache_data_1")
 	b, _ := r.Bytes()
-	var cachedData []domain.CacheData
-	_ = suite.cache.Unmarshal(b, &cachedData)
+	var cached domain.CacheList
+	_ = suite.cache.Unmarshal(b, &cached)
+	cachedData := cached.Data
 
 	assert.Contains(suite.T(), string(body), fmt.Sprintf(`"id":%d`, cachedData[0].Id))
 	assert.Contains(suite.T(), string(body), fmt.Sprintf(`"user_id":%d`, cachedData[0].UserId))
@@ -325,8 +408,8 @@ func (suite *Suite) Test_GetData_ByUser_FromDb_SetToCache() {
 
 func (suite *Suite) Test_GetData_ByStubAdmin_FromDb_SetToCache() {
 
-	suite.usersRepoStub.IsAdminStub = func(userId int) bool {
-		return true
+	suite.usersRepoStub.GetPermissionsStub = func(ctx context.Context, userId int) (domain.Permissions, error) {
+		return domain.Permissions{domain.PermissionDataReadAll}, nil
 	}
 
 	suite.afterExecDynamic = func() {
@@ -334,16 +417,17 @@ func (suite *Suite) Test_GetData_ByStubAdmin_FromDb_SetToCache() {
 		suite.CreateUserWithData(3, "message_3")
 	}
 
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
 
 	for i := 1; i <= 3; i++ {
-		r := suite.redis.Get(context.Background(), "cache_"+strconv.Itoa(i))
+		r := suite.redis.Get(context.Background(), "cache_data_"+strconv.Itoa(i))
 		b, _ := r.Bytes()
-		var cachedData []domain.CacheData
-		_ = suite.cache.Unmarshal(b, &cachedData)
+		var cached domain.CacheList
+		_ = suite.cache.Unmarshal(b, &cached)
+		cachedData := cached.Data
 
 		assert.Contains(suite.T(), string(body), fmt.Sprintf(`"id":%d`, cachedData[0].Id))
 		assert.Contains(suite.T(), string(body), fmt.Sprintf(`"user_id":%d`, cachedData[0].UserId))
@@ -362,16 +446,17 @@ func (suite *Suite) Test_GetData_ByRealAdmin_FromDb_SetToCache() {
 		err := args[0].(error)
 		assert.Error(suite.T(), err)
 	}
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 
 	body, _ := json.Marshal(response.Body)
 	assert.Equal(suite.T(), http.StatusOK, response.Status)
 
 	for i := 1; i <= 3; i++ {
-		r := suite.redis.Get(context.Background(), "cache_"+strconv.Itoa(i))
+		r := suite.redis.Get(context.Background(), "cache_data_"+strconv.Itoa(i))
 		b, _ := r.Bytes()
-		var cachedData []domain.CacheData
-		_ = suite.cache.Unmarshal(b, &cachedData)
+		var cached domain.CacheList
+		_ = suite.cache.Unmarshal(b, &cached)
+		cachedData := cached.Data
 
 		assert.Contains(suite.T(), string(body), fmt.Sprintf(`"id":%d`, cachedData[0].Id))
 		assert.Contains(suite.T(), string(body), fmt.Sprintf(`"user_id":%d`, cachedData[0].UserId))
@@ -386,16 +471,19 @@ func (suite *Suite) Test_GetData_ByRealAdmin_FromDb_Error() {
 		suite.CreateUserWithData(2, "message_2")
 		suite.CreateUserWithData(3, "message_3")
 	}
+	// roles tables are dropped along with data
+	suite.usersRepoStub.GetPermissionsStub = func(ctx context.Context, userId int) (domain.Permissions, error) {
+		return domain.Permissions{domain.PermissionDataReadAll}, nil
+	}
 
 	suite.afterExecDynamic = func() {
 		// Роняем миграции, чтобы запрос не прошел
 		if err := goose.SetDialect("postgres"); err != nil {
 			panic(err)
 		}
-		for _ = range 3 {
-			if err := goose.Down(suite.db, "../../migrations"); err != nil {
-				panic(err)
-			}
+		// оставляем только таблицу users
+		if err := goose.DownTo(suite.db, "../../migrations", 20240414195740); err != nil {
+			panic(err)
 		}
 	}
 
@@ -403,7 +491,7 @@ func (suite *Suite) Test_GetData_ByRealAdmin_FromDb_Error() {
 		err := args[0].(error)
 		assert.Error(suite.T(), err)
 	}
-	response := suite.build().GetData(suite.getToken())
+	response := suite.build().GetData(context.Background(), suite.getToken())
 	if err := goose.Up(suite.db, "../../migrations"); err != nil {
 		panic(err)
 	}
@@ -411,3 +499,1402 @@ func (suite *Suite) Test_GetData_ByRealAdmin_FromDb_Error() {
 	assert.Equal(suite.T(), http.StatusInternalServerError, response.Status)
 
 }
+
+func (suite *Suite) Test_GetDataPage_ByUser_NextCursor() {
+	suite.afterExecDynamic = func() {
+		_, err := suite.db.Exec("INSERT INTO data (id, user_id, data) values (2, 1, 'message_2')")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	response := suite.build().GetDataPage(context.Background(), suite.getToken(), 0, 1)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"id":1`)
+	assert.NotContains(suite.T(), string(body), `"id":2`)
+	assert.Contains(suite.T(), string(body), `"next_cursor":1`)
+}
+
+func (suite *Suite) Test_GetDataPage_ByUser_LastPage() {
+	response := suite.build().GetDataPage(context.Background(), suite.getToken(), 0, 10)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"id":1`)
+	assert.NotContains(suite.T(), string(body), `"next_cursor"`)
+}
+
+func (suite *Suite) Test_GetDataPage_ByUser_FromCache() {
+	_ = suite.build().GetDataPage(context.Background(), suite.getToken(), 0, 10)
+
+	suite.dbDataRepoStub.GetDataPageByUserStub = func(ctx context.Context, userId int, afterId int, limit int) ([]domain.Data, error) {
+		return nil, errors.New("must be taken from cache")
+	}
+	suite.cachedDataRepoStub.RealAdapter = domain.NewCachedDataRepository(suite.dbDataRepoStub, &suite.cacheStub, TestsKeyPrefix, suite.loggerStub, suite.cacheOptions)
+	suite.dataServiceStub.Service = services.NewDataService(suite.cachedDataRepoStub, suite.usersRepoStub)
+
+	response := controller.NewDataController(suite.authServiceStub, suite.dataServiceStub, suite.loggerStub).GetDataPage(context.Background(), suite.getToken(), 0, 10)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"id":1`)
+}
+
+func (suite *Suite) Test_GetDataPage_ByRealAdmin() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+		suite.CreateUserWithData(3, "message_3")
+	}
+
+	response := suite.build().GetDataPage(context.Background(), suite.getToken(), 1, 1)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"data":"message_2"`)
+	assert.NotContains(suite.T(), string(body), `"data":"message_3"`)
+	assert.Contains(suite.T(), string(body), `"next_cursor":2`)
+}
+
+func (suite *Suite) Test_GetDataHandler_ByRealAdmin_DefaultsToFirstPage() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	suite.dbDataRepoStub.GetDataByAdminStub = func(ctx context.Context) ([]domain.Data, error) {
+		suite.T().Fatal("the whole table is loaded")
+		return nil, nil
+	}
+	dataController := suite.build()
+
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/data", nil)
+	ctx.Request.Header.Set("Authorization", suite.getToken())
+	dataController.GetDataHandler(ctx)
+
+	assert.Equal(suite.T(), http.StatusOK, recorder.Code)
+	assert.Contains(suite.T(), recorder.Body.String(), `"data":"message_2"`)
+	assert.NotContains(suite.T(), recorder.Body.String(), `next_cursor`)
+}
+
+func (suite *Suite) Test_CreateData_ByUser_RefreshCache() {
+	suite.afterExecDynamic = func() {
+		// Записи в тестах создаются с явными id, поэтому сдвигаем последовательность
+		_, err := suite.db.Exec("SELECT setval('data_id_seq', 100)")
+		if err != nil {
+			panic(err)
+		}
+	}
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+
+	response := dataController.CreateData(context.Background(), suite.getToken(), controller.DataRequest{Data: "new_message"})
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusCreated, response.Status)
+	assert.Contains(suite.T(), string(body), `"id":101`)
+	assert.Contains(suite.T(), string(body), `"data":"new_message"`)
+
+	r := suite.redis.Get(context.Background(), "cache_data_1")
+	b, _ := r.Bytes()
+	var cached domain.CacheList
+	_ = suite.cache.Unmarshal(b, &cached)
+	cachedData := cached.Data
+	assert.Len(suite.T(), cachedData, 2)
+}
+
+func (suite *Suite) Test_CreateData_ForOtherUser_Forbidden() {
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+
+	response := suite.build().CreateData(context.Background(), suite.getToken(), controller.DataRequest{UserId: 2, Data: "new_message"})
+
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_UpdateData_ByUser_NotOwner() {
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+
+	response := suite.build().UpdateData(context.Background(), suite.getToken(), 2, controller.DataRequest{Data: "new_message"})
+
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_UpdateData_ByRealAdmin() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+
+	response := suite.build().UpdateData(context.Background(), suite.getToken(), 2, controller.DataRequest{Data: "new_message"})
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"user_id":2`)
+	assert.Contains(suite.T(), string(body), `"data":"new_message"`)
+
+	r := suite.redis.Get(context.Background(), "cache_data_2")
+	b, _ := r.Bytes()
+	var cached domain.CacheList
+	_ = suite.cache.Unmarshal(b, &cached)
+	cachedData := cached.Data
+	assert.Equal(suite.T(), "new_message", cachedData[0].Data)
+}
+
+func (suite *Suite) Test_DeleteData_ByUser() {
+	suite.afterExecDynamic = func() {
+		_, err := suite.db.Exec("INSERT INTO data (id, user_id, data) values (2, 1, 'message_2')")
+		if err != nil {
+			panic(err)
+		}
+	}
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+
+	response := dataController.DeleteData(context.Background(), suite.getToken(), 1)
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = dataController.GetData(context.Background(), suite.getToken())
+	body, _ := json.Marshal(response.Body)
+	assert.NotContains(suite.T(), string(body), `"id":1,`)
+	assert.Contains(suite.T(), string(body), `"id":2`)
+}
+
+func (suite *Suite) Test_GetDataById_ByOwner_SetToCache() {
+	response := suite.build().GetDataById(context.Background(), suite.getToken(), 1)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"id":1`)
+	assert.Contains(suite.T(), string(body), `"data":"some_data"`)
+
+	r := suite.redis.Get(context.Background(), "cache_data_record_1")
+	b, _ := r.Bytes()
+	var cachedData domain.CacheData
+	_ = suite.cache.Unmarshal(b, &cachedData)
+	assert.Equal(suite.T(), "some_data", cachedData.Data)
+}
+
+func (suite *Suite) Test_GetDataById_ByNotOwner_Forbidden() {
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+
+	response := suite.build().GetDataById(context.Background(), suite.getToken(), 2)
+
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_GetDataById_ByRealAdmin() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+
+	response := suite.build().GetDataById(context.Background(), suite.getToken(), 2)
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"data":"message_2"`)
+}
+
+func (suite *Suite) Test_GetDataById_NotFound() {
+	response := suite.build().GetDataById(context.Background(), suite.getToken(), 100)
+
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_NotifyListener_InvalidatesCache() {
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+
+	cachedRepo := suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = NewNotifyListener(suite.dbContainer.DSN, cachedRepo, nil, suite.loggerStub).Run(ctx)
+	}()
+
+	assert.Eventually(suite.T(), func() bool {
+		_, err := suite.db.Exec("UPDATE data SET data = 'new_data' WHERE id = 1")
+		if err != nil {
+			panic(err)
+		}
+		body, _ := json.Marshal(dataController.GetData(context.Background(), suite.getToken()).Body)
+		return strings.Contains(string(body), `"data":"new_data"`)
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func (suite *Suite) Test_DataTrigger_NotifiesOncePerStatementAndUser() {
+	suite.execDynamic()
+	listener := pq.NewListener(suite.dbContainer.DSN, time.Second, time.Minute, nil)
+	defer listener.Close()
+	assert.Nil(suite.T(), listener.Listen(InvalidationChannel))
+
+	_, err := suite.db.Exec("INSERT INTO data (id, user_id, data) SELECT i, $1, 'bulk' FROM generate_series(101, 103) i", suite.user.Id)
+	assert.Nil(suite.T(), err)
+
+	select {
+	case n := <-listener.Notify:
+		var notification Notification
+		assert.Nil(suite.T(), json.Unmarshal([]byte(n.Extra), &notification))
+		assert.Equal(suite.T(), Notification{Table: tableData, UserId: suite.user.Id, Ids: []int{101, 102, 103}}, notification)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("no notification")
+	}
+	select {
+	case n := <-listener.Notify:
+		suite.T().Fatalf("unexpected notification %s", n.Extra)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func (suite *Suite) Test_LocalInvalidator_DropsKeyOnOtherInstance() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newInstance := func() cache.Cache {
+		localCache := cache.NewResettableLocalCache(100, time.Minute)
+		local := cachepkg.New(&cachepkg.Options{
+			Redis:      suite.redis,
+			LocalCache: localCache,
+		})
+		invalidator := cache.NewLocalInvalidator(suite.redis, localCache, "test_invalidation", suite.loggerStub)
+		go func() {
+			_ = invalidator.Run(ctx)
+		}()
+		return cache.NewInvalidatingCacheAdapter(time.Minute, local, suite.redis, invalidator)
+	}
+	first, second := newInstance(), newInstance()
+
+	assert.Nil(suite.T(), second.Set(ctx, "cache_key", "old"))
+	var value string
+	assert.Nil(suite.T(), second.Get(ctx, "cache_key", &value))
+	assert.Equal(suite.T(), "old", value)
+
+	assert.Eventually(suite.T(), func() bool {
+		_ = first.Set(ctx, "cache_key", "new")
+		var value string
+		_ = second.Get(ctx, "cache_key", &value)
+		return value == "new"
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func (suite *Suite) Test_LocalInvalidator_DropsLocalCacheOnSubscription() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localCache := cache.NewResettableLocalCache(100, time.Minute)
+	localCache.Set("cache_key", []byte("stale"))
+
+	invalidator := cache.NewLocalInvalidator(suite.redis, localCache, "test_invalidation", suite.loggerStub)
+	go func() {
+		_ = invalidator.Run(ctx)
+	}()
+
+	assert.Eventually(suite.T(), func() bool {
+		_, ok := localCache.Get("cache_key")
+		return !ok
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestLocalInvalidator_RetriesSubscription(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+
+	var errorsCount atomic.Int32
+	invalidator := cache.NewLocalInvalidator(client, cache.NewResettableLocalCache(100, time.Minute), "test_invalidation",
+		logger.Stub{ErrorStub: func(args ...interface{}) {
+			errorsCount.Add(1)
+		}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, invalidator.Run(ctx))
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, errorsCount.Load(), int32(2))
+}
+
+func (suite *Suite) Test_Cache_InvalidatePrefix() {
+	ctx := context.Background()
+	adapter := cache.NewCacheAdapter(time.Minute, suite.cache, suite.redis)
+	for i := 0; i < 2500; i++ {
+		assert.Nil(suite.T(), adapter.Set(ctx, fmt.Sprintf("cache_%d", i), i))
+	}
+	assert.Nil(suite.T(), adapter.Set(ctx, "other_1", 1))
+
+	assert.Nil(suite.T(), adapter.InvalidatePrefix(ctx, "cache_"))
+
+	keys, err := suite.redis.Keys(ctx, "*").Result()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"other_1"}, keys)
+}
+
+func (suite *Suite) Test_CachedDataRepository_PurgeUser() {
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+	_ = dataController.GetDataPage(context.Background(), suite.getToken(), 0, 10)
+	_ = dataController.GetDataById(context.Background(), suite.getToken(), 1)
+
+	cachedRepo := suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository)
+	assert.Nil(suite.T(), cachedRepo.PurgeUser(context.Background(), 1))
+
+	keys, err := suite.redis.Keys(context.Background(), "cache_data_1*").Result()
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), keys)
+	assert.Equal(suite.T(), int64(1), suite.redis.Exists(context.Background(), "cache_data_record_1").Val())
+}
+
+func (suite *Suite) Test_CachedDataRepository_PurgeAll_KeepsRevocations() {
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+	_ = dataController.GetDataById(context.Background(), suite.getToken(), 1)
+	revocations := domain.NewRedisRevocationRepository(suite.redis, TestsKeyPrefix)
+	assert.Nil(suite.T(), revocations.RevokeToken(context.Background(), "revoked_jti", time.Now().Add(time.Hour)))
+	assert.Nil(suite.T(), revocations.RevokeUserTokens(context.Background(), suite.user.Id, time.Now()))
+
+	cachedRepo := suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository)
+	assert.Nil(suite.T(), cachedRepo.PurgeAll(context.Background()))
+
+	keys, err := suite.redis.Keys(context.Background(), "cache_data_*").Result()
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), keys)
+	revoked, err := revocations.IsTokenRevoked(context.Background(), "revoked_jti")
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), revoked)
+	before, err := revocations.GetUserRevokedBefore(context.Background(), suite.user.Id)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), before.IsZero())
+}
+
+func (suite *Suite) Test_GetDataPage_ByUser_NotCachedAfterConcurrentWrite() {
+	var dbCalls atomic.Int32
+	realRepo := domain.NewDbDataRepository(suite.db)
+	var cachedRepo *domain.CachedDataRepository
+	suite.dbDataRepoStub.GetDataPageByUserStub = func(ctx context.Context, userId int, afterId int, limit int) ([]domain.Data, error) {
+		data, err := realRepo.GetDataPageByUser(ctx, userId, afterId, limit)
+		// the first query races with a write, which invalidates pages after the query
+		if dbCalls.Add(1) == 1 {
+			assert.Nil(suite.T(), cachedRepo.InvalidateUser(ctx, userId))
+		}
+		return data, err
+	}
+	dataController := suite.build()
+	cachedRepo = suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository)
+
+	assert.Equal(suite.T(), http.StatusOK, dataController.GetDataPage(context.Background(), suite.getToken(), 0, 10).Status)
+	keys, err := suite.redis.Keys(context.Background(), "cache_data_1_page_*_0_10").Result()
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), keys)
+
+	// pages are cached again, once the generation is stable
+	assert.Equal(suite.T(), http.StatusOK, dataController.GetDataPage(context.Background(), suite.getToken(), 0, 10).Status)
+	assert.Equal(suite.T(), http.StatusOK, dataController.GetDataPage(context.Background(), suite.getToken(), 0, 10).Status)
+	assert.Equal(suite.T(), int32(2), dbCalls.Load())
+}
+
+func (suite *Suite) Test_GetData_ByUser_CoalescesDbQueries() {
+	var dbCalls atomic.Int32
+	realRepo := domain.NewDbDataRepository(suite.db)
+	suite.dbDataRepoStub.GetDataByUserStub = func(ctx context.Context, userId int) ([]domain.Data, error) {
+		dbCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return realRepo.GetDataByUser(ctx, userId)
+	}
+	dataController := suite.build()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := dataController.GetData(context.Background(), suite.getToken())
+			assert.Equal(suite.T(), http.StatusOK, response.Status)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(suite.T(), int32(1), dbCalls.Load())
+}
+
+func (suite *Suite) Test_GetData_ByUser_StaleWhileRevalidate() {
+	suite.cacheOptions.SoftTTL = 50 * time.Millisecond
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+
+	_, err := suite.db.Exec("UPDATE data SET data = 'new_data' WHERE id = 1")
+	if err != nil {
+		panic(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	body, _ := json.Marshal(dataController.GetData(context.Background(), suite.getToken()).Body)
+	assert.Contains(suite.T(), string(body), `"data":"some_data"`)
+
+	assert.Eventually(suite.T(), func() bool {
+		body, _ := json.Marshal(dataController.GetData(context.Background(), suite.getToken()).Body)
+		return strings.Contains(string(body), `"data":"new_data"`)
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func (suite *Suite) Test_GetData_ByUser_StaleWhileRevalidate_SingleRefresh() {
+	suite.cacheOptions.SoftTTL = 50 * time.Millisecond
+	var dbCalls atomic.Int32
+	realRepo := domain.NewDbDataRepository(suite.db)
+	suite.dbDataRepoStub.GetDataByUserStub = func(ctx context.Context, userId int) ([]domain.Data, error) {
+		dbCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return realRepo.GetDataByUser(ctx, userId)
+	}
+	dataController := suite.build()
+	_ = dataController.GetData(context.Background(), suite.getToken())
+	time.Sleep(100 * time.Millisecond)
+
+	for range 10 {
+		assert.Equal(suite.T(), http.StatusOK, dataController.GetData(context.Background(), suite.getToken()).Status)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	assert.Equal(suite.T(), int32(2), dbCalls.Load())
+	keys, _ := suite.redis.Keys(context.Background(), "cache_*stored_at").Result()
+	assert.Empty(suite.T(), keys)
+}
+
+func (suite *Suite) Test_GetData_UnknownUser_EmptyResultCached() {
+	suite.cacheOptions.EmptyTTL = time.Minute
+	suite.usersRepoStub.GetPermissionsStub = func(ctx context.Context, userId int) (domain.Permissions, error) {
+		return domain.Permissions{domain.PermissionDataReadOwn}, nil
+	}
+	var dbCalls atomic.Int32
+	realRepo := domain.NewDbDataRepository(suite.db)
+	suite.dbDataRepoStub.GetDataByUserStub = func(ctx context.Context, userId int) ([]domain.Data, error) {
+		dbCalls.Add(1)
+		return realRepo.GetDataByUser(ctx, userId)
+	}
+	dataController := suite.build()
+	suite.token, _ = suite.authService.GenerateToken(999)
+
+	for range 2 {
+		response := dataController.GetData(context.Background(), suite.getToken())
+		body, _ := json.Marshal(response.Body)
+		assert.Equal(suite.T(), http.StatusOK, response.Status)
+		assert.JSONEq(suite.T(), `{"data":[]}`, string(body))
+	}
+
+	assert.Equal(suite.T(), int32(1), dbCalls.Load())
+	ttl := suite.redis.TTL(context.Background(), "cache_data_999").Val()
+	assert.Greater(suite.T(), ttl, 10*time.Second)
+	assert.LessOrEqual(suite.T(), ttl, time.Minute)
+}
+
+func (suite *Suite) Test_GetData_ByUser_FromCache_Error_Logged() {
+	suite.cacheStub.GetStub = func(ctx context.Context, key string, dest interface{}) error {
+		return errors.New("cache is down")
+	}
+	var logged []error
+	suite.loggerStub.ErrorStub = func(args ...interface{}) {
+		logged = append(logged, args[0].(error))
+	}
+
+	response := suite.build().GetData(context.Background(), suite.getToken())
+
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.NotEmpty(suite.T(), logged)
+	assert.Contains(suite.T(), logged[0].Error(), "cache is down")
+}
+
+func (suite *Suite) Test_GetData_ByUser_FromCache_Error_FailClosed() {
+	suite.cacheOptions.FailClosed = true
+	suite.cacheStub.GetStub = func(ctx context.Context, key string, dest interface{}) error {
+		return errors.New("cache is down")
+	}
+	suite.dbDataRepoStub.GetDataByUserStub = func(ctx context.Context, userId int) ([]domain.Data, error) {
+		panic("db must not be queried in fail-closed mode")
+	}
+
+	response := suite.build().GetData(context.Background(), suite.getToken())
+
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+}
+
+func (suite *Suite) Test_GetData_ByUser_FromDb_Error_NotCached() {
+	suite.dbDataRepoStub.GetDataByUserStub = func(ctx context.Context, userId int) ([]domain.Data, error) {
+		return nil, errors.New("db is down")
+	}
+	suite.cacheStub.SetStub = func(ctx context.Context, key string, value interface{}) error {
+		panic("db error must not be cached")
+	}
+	suite.cacheStub.SetWithTTLStub = func(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+		panic("db error must not be cached")
+	}
+
+	response := suite.build().GetData(context.Background(), suite.getToken())
+
+	assert.Equal(suite.T(), http.StatusInternalServerError, response.Status)
+}
+
+func (suite *Suite) Test_GetData_CanceledContext() {
+	dataController := suite.build()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := dataController.GetData(ctx, suite.getToken())
+
+	assert.Equal(suite.T(), http.StatusInternalServerError, response.Status)
+}
+
+func (suite *Suite) newHealthController(cache controller.Pinger, isReady bool) *controller.HealthController {
+	return controller.NewHealthController(
+		controller.PingerFunc(suite.db.PingContext),
+		cache,
+		func() bool { return isReady },
+		time.Second,
+		false,
+		suite.loggerStub,
+	)
+}
+
+func (suite *Suite) redisPinger() controller.Pinger {
+	return controller.PingerFunc(func(ctx context.Context) error {
+		return suite.redis.Ping(ctx).Err()
+	})
+}
+
+func (suite *Suite) Test_Readiness_Ready() {
+	response := suite.newHealthController(suite.redisPinger(), true).Readiness(context.Background())
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.JSONEq(suite.T(), `{"status":"ready","checks":{"db":{"status":"up"},"cache":{"status":"up"}}}`, string(body))
+}
+
+func (suite *Suite) Test_Readiness_CacheDown_Degraded() {
+	cache := controller.PingerFunc(func(ctx context.Context) error {
+		return errors.New("redis is down")
+	})
+
+	var logged []error
+	suite.loggerStub.ErrorStub = func(args ...interface{}) {
+		logged = append(logged, args[0].(error))
+	}
+
+	response := suite.newHealthController(cache, true).Readiness(context.Background())
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"status":"degraded"`)
+	assert.NotContains(suite.T(), string(body), "redis is down")
+	if assert.Len(suite.T(), logged, 1) {
+		assert.Contains(suite.T(), logged[0].Error(), "redis is down")
+	}
+}
+
+func (suite *Suite) Test_Readiness_CacheDown_FailClosed_NotReady() {
+	healthController := controller.NewHealthController(
+		controller.PingerFunc(suite.db.PingContext),
+		controller.PingerFunc(func(ctx context.Context) error {
+			return errors.New("redis is down")
+		}),
+		func() bool { return true },
+		time.Second,
+		true,
+		suite.loggerStub,
+	)
+
+	response := healthController.Readiness(context.Background())
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+	assert.JSONEq(suite.T(), `{"status":"not_ready","checks":{"db":{"status":"up"},"cache":{"status":"down"}}}`, string(body))
+}
+
+func (suite *Suite) Test_Readiness_DbDown_NotReady() {
+	healthController := controller.NewHealthController(
+		controller.PingerFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		suite.redisPinger(),
+		func() bool { return true },
+		100*time.Millisecond,
+		false,
+		suite.loggerStub,
+	)
+
+	response := healthController.Readiness(context.Background())
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+	assert.Contains(suite.T(), string(body), `"status":"not_ready"`)
+	assert.Contains(suite.T(), string(body), `"db":{"status":"down"}`)
+}
+
+func (suite *Suite) Test_Readiness_ShuttingDown() {
+	response := suite.newHealthController(suite.redisPinger(), false).Readiness(context.Background())
+
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+}
+
+func (suite *Suite) Test_GetData_GetClaims_TypedError() {
+	suite.authServiceStub.GetClaimsStub = func(ctx context.Context, token string) (claims *auth.TokenClaims, err error) {
+		return nil, fmt.Errorf("%w: %w", auth.ErrTokenExpired, errors.New("token has invalid claims: token is expired"))
+	}
+
+	response := suite.build().GetData(context.Background(), suite.getToken())
+
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"token is expired"}`, string(body))
+}
+
+func (suite *Suite) buildAuthController(revocationRepo domain.IRevocationRepository) (*controller.DataController, *controller.AuthController) {
+	revocationService := services.NewRevocationService(revocationRepo, suite.usersRepoStub, time.Second, time.Hour)
+	apiKeyService := services.NewApiKeyService(domain.NewDbApiKeyRepository(suite.db), suite.usersRepoStub, revocationService, suite.loggerStub)
+	suite.authServiceStub.RealService = auth.NewChainService(suite.authService, apiKeyService)
+	dataController := suite.build()
+	suite.authService.Revocations = revocationService
+	tokenService := services.NewTokenService(suite.authService, domain.NewDbRefreshTokenRepository(suite.db), revocationRepo,
+		suite.usersRepoStub, time.Hour)
+	return dataController, controller.NewAuthController(suite.authServiceStub, revocationService, tokenService, apiKeyService, suite.loggerStub)
+}
+
+func (suite *Suite) newRevocationRepository() *domain.FallbackRevocationRepository {
+	redisRepo := domain.NewRedisRevocationRepository(suite.redis, TestsKeyPrefix)
+	// there are no revocations in db yet, like after the copy on start
+	if err := redisRepo.MarkSynced(context.Background()); err != nil {
+		panic(err)
+	}
+	return domain.NewFallbackRevocationRepository(redisRepo, domain.NewDbRevocationRepository(suite.db), suite.loggerStub)
+}
+
+func (suite *Suite) Test_Revoke_Token() {
+	suite.user.AccessLevel = "admin"
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	adminToken := suite.getToken()
+
+	userToken, _ := suite.authService.GenerateToken(2)
+	suite.CreateUserWithData(2, "message_2")
+	claims, err := suite.authService.GetClaims(context.Background(), "Bearer "+userToken)
+	assert.Nil(suite.T(), err)
+
+	response := authController.Revoke(context.Background(), adminToken, controller.RevokeRequest{Jti: claims.ID})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = dataController.GetData(context.Background(), "Bearer "+userToken)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"token is revoked"}`, string(body))
+
+	// the revocation is stored in both redis and db
+	exists, _ := suite.redis.Exists(context.Background(), TestsKeyPrefix+":revoked_token:"+claims.ID).Result()
+	assert.Equal(suite.T(), int64(1), exists)
+	var count int
+	_ = suite.db.QueryRow("SELECT count(*) FROM revoked_tokens WHERE jti = $1", claims.ID).Scan(&count)
+	assert.Equal(suite.T(), 1, count)
+
+	response = dataController.GetData(context.Background(), adminToken)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+}
+
+func (suite *Suite) Test_Revoke_UserTokens() {
+	suite.user.AccessLevel = "admin"
+	revocationRepo := suite.newRevocationRepository()
+	dataController, authController := suite.buildAuthController(revocationRepo)
+	adminToken := suite.getToken()
+
+	suite.CreateUserWithData(2, "message_2")
+	userToken, _ := suite.authService.GenerateToken(2)
+	response := dataController.GetData(context.Background(), "Bearer "+userToken)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+
+	response = authController.Revoke(context.Background(), adminToken, controller.RevokeRequest{UserId: 2})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = dataController.GetData(context.Background(), "Bearer "+userToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+
+	// the revocation is stored with the resolution of iat
+	before, err := revocationRepo.GetUserRevokedBefore(context.Background(), 2)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), before.IsZero())
+	assert.Equal(suite.T(), 0, before.Nanosecond())
+
+	response = authController.Revoke(context.Background(), adminToken, controller.RevokeRequest{UserId: 999})
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_Revoke_ByUser_Forbidden() {
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	response := authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{UserId: 1})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+
+	response = authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{})
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Status)
+}
+
+func (suite *Suite) Test_Revoke_RedisDown_FallsBackToDb() {
+	suite.user.AccessLevel = "admin"
+	redisErr := errors.New("redis is down")
+	primary := domain.RevocationRepositoryStub{
+		RevokeTokenStub: func(ctx context.Context, jti string, expiresAt time.Time) error {
+			return redisErr
+		},
+		IsTokenRevokedStub: func(ctx context.Context, jti string) (bool, error) {
+			return false, redisErr
+		},
+		GetUserRevokedBeforeStub: func(ctx context.Context, userId int) (time.Time, error) {
+			return time.Time{}, redisErr
+		},
+	}
+	repo := domain.NewFallbackRevocationRepository(primary, domain.NewDbRevocationRepository(suite.db), suite.loggerStub)
+	dataController, authController := suite.buildAuthController(repo)
+
+	claims, err := suite.authService.GetClaims(context.Background(), suite.getToken())
+	assert.Nil(suite.T(), err)
+	response := authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{Jti: claims.ID})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	// a new service without the local cache of the revocation
+	suite.authService.Revocations = services.NewRevocationService(repo, suite.usersRepoStub, 0, time.Hour)
+	response = dataController.GetData(context.Background(), suite.getToken())
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+}
+
+func (suite *Suite) Test_Revoke_RedisLostRevocations_FallsBackToDbUntilSynced() {
+	suite.execDynamic()
+	ctx := context.Background()
+	dbRepo := domain.NewDbRevocationRepository(suite.db)
+	redisRepo := domain.NewRedisRevocationRepository(suite.redis, TestsKeyPrefix)
+	repo := domain.NewFallbackRevocationRepository(redisRepo, dbRepo, suite.loggerStub)
+	assert.Nil(suite.T(), dbRepo.SyncTo(ctx, redisRepo))
+	assert.Nil(suite.T(), repo.RevokeToken(ctx, "revoked_jti", time.Now().Add(time.Hour)))
+	assert.Nil(suite.T(), repo.RevokeUserTokens(ctx, suite.user.Id, time.Now()))
+
+	// redis is restarted without persistence
+	assert.Nil(suite.T(), suite.redis.FlushAll(ctx).Err())
+	_, err := redisRepo.IsTokenRevoked(ctx, "revoked_jti")
+	assert.ErrorIs(suite.T(), err, domain.ErrRevocationsNotSynced)
+	_, err = redisRepo.GetUserRevokedBefore(ctx, suite.user.Id)
+	assert.ErrorIs(suite.T(), err, domain.ErrRevocationsNotSynced)
+	revoked, err := repo.IsTokenRevoked(ctx, "revoked_jti")
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), revoked)
+	before, err := repo.GetUserRevokedBefore(ctx, suite.user.Id)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), before.IsZero())
+
+	assert.Nil(suite.T(), dbRepo.SyncTo(ctx, redisRepo))
+	revoked, err = redisRepo.IsTokenRevoked(ctx, "revoked_jti")
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), revoked)
+	before, err = redisRepo.GetUserRevokedBefore(ctx, suite.user.Id)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), before.IsZero())
+	revoked, err = redisRepo.IsTokenRevoked(ctx, "other_jti")
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), revoked)
+}
+
+func (suite *Suite) Test_Revoke_Unavailable() {
+	dataController, _ := suite.buildAuthController(domain.RevocationRepositoryStub{
+		IsTokenRevokedStub: func(ctx context.Context, jti string) (bool, error) {
+			return false, errors.New("db is down")
+		},
+	})
+
+	response := dataController.GetData(context.Background(), suite.getToken())
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+}
+
+func (suite *Suite) Test_IssueToken_AndRefresh() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	response := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	issued := response.Body.(controller.TokenResponse)
+	assert.Equal(suite.T(), "Bearer", issued.TokenType)
+	assert.NotEmpty(suite.T(), issued.RefreshToken)
+
+	response = dataController.GetData(context.Background(), "Bearer "+issued.AccessToken)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	refreshed := response.Body.(controller.TokenResponse)
+	assert.NotEqual(suite.T(), issued.RefreshToken, refreshed.RefreshToken)
+
+	claims, err := suite.authService.GetClaims(context.Background(), "Bearer "+refreshed.AccessToken)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), suite.user.Id, claims.UserID)
+
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: "unknown"})
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+}
+
+func (suite *Suite) Test_RefreshToken_Reuse_RevokesFamily() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	issued := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{}).Body.(controller.TokenResponse)
+	refreshed := authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken}).Body.(controller.TokenResponse)
+
+	// the first refresh token is presented again, e.g. by an attacker
+	response := authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken})
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Contains(suite.T(), string(body), services.ErrRefreshTokenReused.Error())
+
+	// the whole family is revoked
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: refreshed.RefreshToken})
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	response = dataController.GetData(context.Background(), "Bearer "+refreshed.AccessToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+
+	// tokens issued before are not affected
+	response = dataController.GetData(context.Background(), suite.getToken())
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+}
+
+func (suite *Suite) Test_RefreshToken_AfterUserRevocation() {
+	suite.user.AccessLevel = "admin"
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	issued := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{}).Body.(controller.TokenResponse)
+	response := authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{UserId: suite.user.Id})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken})
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Contains(suite.T(), string(body), services.ErrInvalidRefreshToken.Error())
+}
+
+func (suite *Suite) Test_RefreshToken_Failure_KeepsTokenUnused() {
+	unavailable := true
+	_, authController := suite.buildAuthController(domain.RevocationRepositoryStub{
+		GetUserRevokedBeforeStub: func(ctx context.Context, userId int) (time.Time, error) {
+			if unavailable {
+				return time.Time{}, errors.New("redis is down")
+			}
+			return time.Time{}, nil
+		},
+		IsTokenRevokedStub: func(ctx context.Context, jti string) (bool, error) {
+			return false, nil
+		},
+	})
+	suite.authService.Revocations = nil
+
+	issued := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{}).Body.(controller.TokenResponse)
+	response := authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken})
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+
+	// the refresh token is marked as used only along with storing the new one
+	unavailable = false
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	var count int
+	_ = suite.db.QueryRow("SELECT count(*) FROM refresh_tokens WHERE user_id = $1", suite.user.Id).Scan(&count)
+	assert.Equal(suite.T(), 2, count)
+}
+
+func (suite *Suite) Test_IssueToken_ForOtherUser() {
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+	suite.CreateUserWithData(2, "message_2")
+
+	response := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{UserId: 2})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_IssueToken_ByAdmin_ForOtherUser() {
+	suite.user.AccessLevel = "admin"
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+	suite.CreateUserWithData(2, "message_2")
+
+	response := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{UserId: 2})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	response = authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{UserId: 999})
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_IssueToken_ByDerivedCredentials_Forbidden() {
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+	issued := authController.IssueToken(context.Background(), suite.getToken(), controller.TokenRequest{}).Body.(controller.TokenResponse)
+	apiKey := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{}).Body.(controller.ApiKeyResponse)
+
+	// neither access tokens of refresh tokens nor api keys are prolonged by new refresh tokens
+	for _, token := range []string{"Bearer " + issued.AccessToken, "ApiKey " + apiKey.Key} {
+		response := authController.IssueToken(context.Background(), token, controller.TokenRequest{})
+		body, _ := json.Marshal(response.Body)
+		assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+		assert.Contains(suite.T(), string(body), services.ErrDerivedCredentials.Error())
+	}
+}
+
+func (suite *Suite) Test_Revoke_SourceToken_RevokesRefreshFamily() {
+	suite.user.AccessLevel = "admin"
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	suite.CreateUserWithData(2, "message_2")
+	userToken, _ := suite.authService.GenerateToken(2)
+	claims, err := suite.authService.GetClaims(context.Background(), "Bearer "+userToken)
+	assert.Nil(suite.T(), err)
+
+	issued := authController.IssueToken(context.Background(), "Bearer "+userToken, controller.TokenRequest{}).Body.(controller.TokenResponse)
+	refreshed := authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken}).Body.(controller.TokenResponse)
+	var sourceJti string
+	_ = suite.db.QueryRow("SELECT DISTINCT source_jti FROM refresh_tokens WHERE user_id = 2").Scan(&sourceJti)
+	assert.Equal(suite.T(), claims.ID, sourceJti)
+
+	response := authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{Jti: claims.ID})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: refreshed.RefreshToken})
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	response = dataController.GetData(context.Background(), "Bearer "+refreshed.AccessToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+}
+
+func (suite *Suite) Test_ApiKey_GetData() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	response := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{Name: "ci", Scopes: []string{domain.PermissionDataReadOwn}})
+	assert.Equal(suite.T(), http.StatusCreated, response.Status)
+	created := response.Body.(controller.ApiKeyResponse)
+	assert.NotEmpty(suite.T(), created.Key)
+	assert.Equal(suite.T(), created.Key[:len(created.Prefix)], created.Prefix)
+
+	response = dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Contains(suite.T(), string(body), `"data":"some_data"`)
+
+	// the key is stored only as a hash, and its usage is tracked
+	var hash string
+	var lastUsedAt *time.Time
+	_ = suite.db.QueryRow("SELECT key_hash, last_used_at FROM api_keys WHERE id = $1", created.Id).Scan(&hash, &lastUsedAt)
+	assert.NotEqual(suite.T(), created.Key, hash)
+	assert.NotNil(suite.T(), lastUsedAt)
+
+	claims, err := suite.authServiceStub.GetClaims(context.Background(), "ApiKey "+created.Key)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{domain.PermissionDataReadOwn}, claims.Scopes)
+
+	response = dataController.GetData(context.Background(), "ApiKey unknown")
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+}
+
+func (suite *Suite) Test_ApiKey_Expired() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	expiresAt := time.Now().Add(-time.Minute)
+	created := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{ExpiresAt: &expiresAt}).Body.(controller.ApiKeyResponse)
+
+	response := dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"token is expired"}`, string(body))
+}
+
+func (suite *Suite) Test_ApiKey_Revoked() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	created := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{}).Body.(controller.ApiKeyResponse)
+
+	response := authController.RevokeApiKey(context.Background(), "ApiKey "+created.Key, created.Id)
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"token is revoked"}`, string(body))
+
+	response = authController.RevokeApiKey(context.Background(), suite.getToken(), 999)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_ApiKey_RevokedWithUserTokens() {
+	suite.user.AccessLevel = "admin"
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	created := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{}).Body.(controller.ApiKeyResponse)
+
+	response := authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{UserId: suite.user.Id})
+	assert.Equal(suite.T(), http.StatusNoContent, response.Status)
+
+	response = dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"token is revoked"}`, string(body))
+}
+
+func (suite *Suite) Test_ApiKey_RepositoryDown() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	created := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{}).Body.(controller.ApiKeyResponse)
+
+	var logged []interface{}
+	suite.loggerStub.ErrorStub = func(args ...interface{}) {
+		logged = append(logged, args...)
+	}
+	repo := domain.ApiKeyRepositoryStub{
+		TouchApiKeyStub: func(ctx context.Context, id int) error {
+			return errors.New("db is read-only")
+		},
+		RealAdapter: domain.NewDbApiKeyRepository(suite.db),
+	}
+	apiKeyService := services.NewApiKeyService(repo, suite.usersRepoStub, nil, suite.loggerStub)
+	suite.authServiceStub.RealService = auth.NewChainService(suite.authService, apiKeyService)
+
+	// a failed update of the last usage time doesn't reject the key
+	response := dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Len(suite.T(), logged, 1)
+
+	repo.GetApiKeyByHashStub = func(ctx context.Context, hash string) (domain.ApiKey, error) {
+		return domain.ApiKey{}, errors.New(`pq: relation "api_keys" does not exist`)
+	}
+	apiKeyService = services.NewApiKeyService(repo, suite.usersRepoStub, nil, suite.loggerStub)
+	suite.authServiceStub.RealService = auth.NewChainService(suite.authService, apiKeyService)
+
+	response = dataController.GetData(context.Background(), "ApiKey "+created.Key)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+	assert.Equal(suite.T(), `{"error":"credentials are unavailable"}`, string(body))
+}
+
+func (suite *Suite) Test_ApiKey_ForOtherUser_Forbidden() {
+	_, authController := suite.buildAuthController(suite.newRevocationRepository())
+	suite.CreateUserWithData(2, "message_2")
+
+	response := authController.CreateApiKey(context.Background(), suite.getToken(), controller.ApiKeyRequest{UserId: 2})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) scopedToken(userId int, scopes ...string) string {
+	token, _, err := suite.authService.IssueToken(userId, scopes)
+	if err != nil {
+		panic(err)
+	}
+	return "Bearer " + token
+}
+
+func (suite *Suite) Test_Permissions_ScopesIntersectRoles() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	dataController := suite.build()
+
+	// admin token limited to own data
+	token := suite.scopedToken(suite.user.Id, domain.PermissionDataReadOwn)
+	response := dataController.GetData(context.Background(), token)
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.NotContains(suite.T(), string(body), "message_2")
+
+	response = dataController.CreateData(context.Background(), token, controller.DataRequest{Data: "new"})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+	response = dataController.GetDataById(context.Background(), token, 2)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+
+	// scopes can't grant permissions the user has no roles for
+	token = suite.scopedToken(2, domain.PermissionDataReadAll)
+	response = dataController.GetData(context.Background(), token)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_Permissions_UserRoles() {
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	dataController := suite.build()
+
+	response := dataController.GetDataById(context.Background(), suite.getToken(), 2)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+
+	_, err := suite.db.Exec("INSERT INTO user_roles (user_id, role) VALUES ($1, 'admin')", suite.user.Id)
+	assert.Nil(suite.T(), err)
+	permissions, err := suite.usersRepoStub.GetPermissions(context.Background(), suite.user.Id)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), permissions.Has(domain.PermissionUsersManage))
+
+	response = dataController.GetDataById(context.Background(), suite.getToken(), 2)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+}
+
+func (suite *Suite) Test_Permissions_ScopesInherited() {
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+	token := suite.scopedToken(suite.user.Id, domain.PermissionDataReadOwn)
+
+	// issued tokens keep scopes of the presented token
+	issued := authController.IssueToken(context.Background(), token, controller.TokenRequest{}).Body.(controller.TokenResponse)
+	response := dataController.CreateData(context.Background(), "Bearer "+issued.AccessToken, controller.DataRequest{Data: "new"})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+	refreshed := authController.RefreshToken(context.Background(), controller.RefreshRequest{RefreshToken: issued.RefreshToken}).Body.(controller.TokenResponse)
+	claims, err := suite.authService.GetClaims(context.Background(), "Bearer "+refreshed.AccessToken)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{domain.PermissionDataReadOwn}, claims.Scopes)
+
+	// api keys can't widen them
+	response = authController.CreateApiKey(context.Background(), token, controller.ApiKeyRequest{Scopes: []string{domain.PermissionDataWriteOwn}})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+	response = authController.CreateApiKey(context.Background(), token, controller.ApiKeyRequest{})
+	assert.Equal(suite.T(), http.StatusCreated, response.Status)
+	assert.Equal(suite.T(), []string{domain.PermissionDataReadOwn}, response.Body.(controller.ApiKeyResponse).Scopes)
+}
+
+func (suite *Suite) Test_CachedUserRepository_ExpiresInLocalCache() {
+	suite.execDynamic()
+	var dbCalls atomic.Int32
+	realRepo := domain.NewUserRepository(suite.db)
+	local := cachepkg.New(&cachepkg.Options{
+		Redis:      suite.redis,
+		LocalCache: cachepkg.NewTinyLFU(100, time.Minute),
+	})
+	usersRepo := domain.NewCachedUserRepository(domain.UserRepositoryStub{
+		GetPermissionsStub: func(ctx context.Context, userId int) (domain.Permissions, error) {
+			dbCalls.Add(1)
+			return realRepo.GetPermissions(ctx, userId)
+		},
+	}, cache.NewCacheAdapter(time.Minute, local, suite.redis), TestsKeyPrefix, time.Second, suite.loggerStub)
+
+	// the second read puts the entry to the local cache, which keeps it for a minute
+	for range 2 {
+		_, err := usersRepo.GetPermissions(context.Background(), suite.user.Id)
+		assert.Nil(suite.T(), err)
+	}
+	assert.Equal(suite.T(), int32(1), dbCalls.Load())
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err := usersRepo.GetPermissions(context.Background(), suite.user.Id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int32(2), dbCalls.Load())
+}
+
+func (suite *Suite) Test_CachedUserRepository_InvalidatedOnRoleChanges() {
+	suite.execDynamic()
+	var dbCalls atomic.Int32
+	realRepo := domain.NewUserRepository(suite.db)
+	usersRepo := domain.NewCachedUserRepository(domain.UserRepositoryStub{
+		GetPermissionsStub: func(ctx context.Context, userId int) (domain.Permissions, error) {
+			dbCalls.Add(1)
+			return realRepo.GetPermissions(ctx, userId)
+		},
+	}, &suite.cacheStub, TestsKeyPrefix, time.Minute, suite.loggerStub)
+
+	for range 2 {
+		permissions, err := usersRepo.GetPermissions(context.Background(), suite.user.Id)
+		assert.Nil(suite.T(), err)
+		assert.False(suite.T(), permissions.Has(domain.PermissionUsersManage))
+	}
+	assert.Equal(suite.T(), int32(1), dbCalls.Load())
+
+	cachedRepo := domain.NewCachedDataRepository(suite.dbDataRepoStub, &suite.cacheStub, TestsKeyPrefix, suite.loggerStub, suite.cacheOptions)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = NewNotifyListener(suite.dbContainer.DSN, cachedRepo, usersRepo, suite.loggerStub).Run(ctx)
+	}()
+
+	assert.Eventually(suite.T(), func() bool {
+		_, _ = suite.db.Exec("DELETE FROM user_roles")
+		_, err := suite.db.Exec("INSERT INTO user_roles (user_id, role) VALUES ($1, 'admin')", suite.user.Id)
+		if err != nil {
+			panic(err)
+		}
+		permissions, err := usersRepo.GetPermissions(context.Background(), suite.user.Id)
+		return err == nil && permissions.Has(domain.PermissionUsersManage)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// changes of role permissions invalidate all users
+	defer suite.db.Exec("INSERT INTO role_permissions (role, permission) VALUES ('admin', 'users:manage') ON CONFLICT DO NOTHING")
+	assert.Eventually(suite.T(), func() bool {
+		_, err := suite.db.Exec("DELETE FROM role_permissions WHERE role = 'admin' AND permission = 'users:manage'")
+		if err != nil {
+			panic(err)
+		}
+		permissions, err := usersRepo.GetPermissions(context.Background(), suite.user.Id)
+		return err == nil && !permissions.Has(domain.PermissionUsersManage)
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func (suite *Suite) Test_GetData_DeletedUser_Unauthorized() {
+	dataController := suite.build()
+	_, err := suite.db.Exec("DELETE FROM data WHERE user_id = $1", suite.user.Id)
+	assert.Nil(suite.T(), err)
+	_, err = suite.db.Exec("DELETE FROM users WHERE id = $1", suite.user.Id)
+	assert.Nil(suite.T(), err)
+
+	response := dataController.GetData(context.Background(), suite.getToken())
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	assert.Equal(suite.T(), `{"error":"unknown user"}`, string(body))
+
+	_, err = suite.usersRepoStub.GetAccessLevel(context.Background(), suite.user.Id)
+	assert.ErrorIs(suite.T(), err, domain.ErrUserNotFound)
+	_, err = suite.usersRepoStub.GetPermissions(context.Background(), suite.user.Id)
+	assert.ErrorIs(suite.T(), err, domain.ErrUserNotFound)
+}
+
+func (suite *Suite) Test_GetData_UsersUnavailable() {
+	suite.usersRepoStub.GetPermissionsStub = func(ctx context.Context, userId int) (domain.Permissions, error) {
+		return nil, errors.New("db is down")
+	}
+	dataController, authController := suite.buildAuthController(suite.newRevocationRepository())
+
+	response := dataController.GetData(context.Background(), suite.getToken())
+	body, _ := json.Marshal(response.Body)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+	assert.Equal(suite.T(), `{"error":"users are unavailable"}`, string(body))
+
+	response = authController.Revoke(context.Background(), suite.getToken(), controller.RevokeRequest{UserId: 1})
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, response.Status)
+}
+
+func (suite *Suite) buildUserController() (*controller.DataController, *controller.UserController) {
+	dataController := suite.build()
+	revocationService := services.NewRevocationService(suite.newRevocationRepository(), suite.usersRepoStub, time.Second, time.Hour)
+	suite.authService.Revocations = revocationService
+	cachedRepo := suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository)
+	userService := services.NewUserService(domain.NewDbUserManagementRepository(suite.db), suite.usersRepoStub,
+		revocationService, cachedRepo, nil, suite.loggerStub)
+	return dataController, controller.NewUserController(suite.authServiceStub, userService, suite.loggerStub)
+}
+
+func (suite *Suite) Test_Users_ByAdmin() {
+	suite.user.AccessLevel = "admin"
+	// test users are inserted with explicit ids, which don't advance the sequence
+	suite.afterExecDynamic = func() {
+		_, _ = suite.db.Exec("SELECT setval('users_id_seq', 1000)")
+	}
+	_, userController := suite.buildUserController()
+
+	response := userController.CreateUser(context.Background(), suite.getToken(), controller.UserRequest{AccessLevel: "user"})
+	assert.Equal(suite.T(), http.StatusCreated, response.Status)
+	created := response.Body.(controller.UserResponse)
+	assert.Equal(suite.T(), 1001, created.Id)
+	assert.Equal(suite.T(), "user", created.AccessLevel)
+
+	response = userController.UpdateAccessLevel(context.Background(), suite.getToken(), created.Id, controller.UserRequest{AccessLevel: "admin"})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	accessLevel, err := suite.usersRepoStub.GetAccessLevel(context.Background(), created.Id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "admin", accessLevel)
+
+	response = userController.ListUsers(context.Background(), suite.getToken(), 0, 1)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	page := response.Body.(controller.UsersResponse)
+	assert.Equal(suite.T(), []controller.UserResponse{{Id: suite.user.Id, AccessLevel: "admin"}}, page.Users)
+	assert.Equal(suite.T(), suite.user.Id, *page.NextCursor)
+	response = userController.ListUsers(context.Background(), suite.getToken(), *page.NextCursor, 10)
+	page = response.Body.(controller.UsersResponse)
+	assert.Equal(suite.T(), []controller.UserResponse{{Id: created.Id, AccessLevel: "admin"}}, page.Users)
+	assert.Nil(suite.T(), page.NextCursor)
+
+	response = userController.CreateUser(context.Background(), suite.getToken(), controller.UserRequest{AccessLevel: "root"})
+	assert.Equal(suite.T(), http.StatusBadRequest, response.Status)
+	response = userController.UpdateAccessLevel(context.Background(), suite.getToken(), 999, controller.UserRequest{AccessLevel: "user"})
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+	response = userController.DeactivateUser(context.Background(), suite.getToken(), suite.user.Id)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_Users_UpdateAccessLevel_CacheDown() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	var logged []interface{}
+	suite.loggerStub.ErrorStub = func(args ...interface{}) {
+		logged = append(logged, args...)
+	}
+	_ = suite.build()
+	usersRepo := domain.NewCachedUserRepository(domain.NewUserRepository(suite.db), &suite.cacheStub, TestsKeyPrefix, time.Minute, suite.loggerStub)
+	userService := services.NewUserService(domain.NewDbUserManagementRepository(suite.db), usersRepo,
+		nil, suite.cachedDataRepoStub.RealAdapter.(*domain.CachedDataRepository), usersRepo, suite.loggerStub)
+	userController := controller.NewUserController(suite.authServiceStub, userService, suite.loggerStub)
+	suite.cacheStub.DeleteStub = func(ctx context.Context, keys ...string) error {
+		return errors.New("redis is down")
+	}
+
+	// the change is committed, so a failed invalidation of the cache is only logged
+	response := userController.UpdateAccessLevel(context.Background(), suite.getToken(), 2, controller.UserRequest{AccessLevel: "admin"})
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Equal(suite.T(), controller.UserResponse{Id: 2, AccessLevel: "admin"}, response.Body.(controller.UserResponse))
+	assert.Len(suite.T(), logged, 1)
+}
+
+func (suite *Suite) Test_Users_ByUser_Forbidden() {
+	_, userController := suite.buildUserController()
+
+	response := userController.ListUsers(context.Background(), suite.getToken(), 0, 10)
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+	response = userController.CreateUser(context.Background(), suite.getToken(), controller.UserRequest{AccessLevel: "admin"})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+	response = userController.UpdateAccessLevel(context.Background(), suite.getToken(), suite.user.Id, controller.UserRequest{AccessLevel: "admin"})
+	assert.Equal(suite.T(), http.StatusForbidden, response.Status)
+}
+
+func (suite *Suite) Test_Users_Deactivate() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	dataController, userController := suite.buildUserController()
+	userToken := suite.scopedToken(2)
+	response := dataController.GetData(context.Background(), userToken)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	keys, _ := suite.redis.Keys(context.Background(), "cache_data_2*").Result()
+	assert.NotEmpty(suite.T(), keys)
+
+	response = userController.DeactivateUser(context.Background(), suite.getToken(), 2)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	deactivated := response.Body.(controller.UserResponse)
+	assert.NotNil(suite.T(), deactivated.DeactivatedAt)
+
+	response = dataController.GetData(context.Background(), userToken)
+	assert.Equal(suite.T(), http.StatusUnauthorized, response.Status)
+	keys, _ = suite.redis.Keys(context.Background(), "cache_data_2*").Result()
+	assert.Empty(suite.T(), keys)
+
+	// tokens issued later don't work either, since the user is not found
+	_, err := suite.usersRepoStub.GetPermissions(context.Background(), 2)
+	assert.ErrorIs(suite.T(), err, domain.ErrUserNotFound)
+
+	// tokens are revoked along with the deactivation
+	var revokedBefore time.Time
+	err = suite.db.QueryRow("SELECT revoked_before FROM user_token_revocations WHERE user_id = 2").Scan(&revokedBefore)
+	assert.Nil(suite.T(), err)
+	assert.WithinDuration(suite.T(), *deactivated.DeactivatedAt, revokedBefore, 2*time.Second)
+
+	// the time of the first deactivation is kept
+	response = userController.DeactivateUser(context.Background(), suite.getToken(), 2)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.True(suite.T(), deactivated.DeactivatedAt.Equal(*response.Body.(controller.UserResponse).DeactivatedAt))
+	response = userController.DeactivateUser(context.Background(), suite.getToken(), 999)
+	assert.Equal(suite.T(), http.StatusNotFound, response.Status)
+}
+
+func (suite *Suite) Test_Users_Deactivate_CacheDown() {
+	suite.user.AccessLevel = "admin"
+	suite.afterExecDynamic = func() {
+		suite.CreateUserWithData(2, "message_2")
+	}
+	var logged []interface{}
+	suite.loggerStub.ErrorStub = func(args ...interface{}) {
+		logged = append(logged, args...)
+	}
+	_, userController := suite.buildUserController()
+	suite.cacheStub.DeleteStub = func(ctx context.Context, keys ...string) error {
+		return errors.New("redis is down")
+	}
+
+	// the deactivation is committed, so a failed purge of the cache is only logged
+	response := userController.DeactivateUser(context.Background(), suite.getToken(), 2)
+	assert.Equal(suite.T(), http.StatusOK, response.Status)
+	assert.Len(suite.T(), logged, 1)
+	_, err := suite.usersRepoStub.GetPermissions(context.Background(), 2)
+	assert.ErrorIs(suite.T(), err, domain.ErrUserNotFound)
+}
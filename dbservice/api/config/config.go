@@ -1,18 +1,87 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
 )
 
 type Values struct {
+	// Addr is an address of the http server. By default the port is taken from PORT variable, or ":8080" is used
+	Addr string `yaml:"addr"`
+	// JwtCodePhrase is a single jwt key without kid, it is used if Jwt.KeysDir is empty.
+	// With Jwt.KeysDir it verifies legacy tokens without kid
 	JwtCodePhrase string `yaml:"jwt_code_phrase"`
-	Cache         struct {
-		TTlMilli  int    `yaml:"ttl"`
-		KeyPrefix string `yaml:"key_prefix"`
+	Jwt           struct {
+		// KeysDir is a directory of jwt keys, e.g. a mounted secret. The name of each file is the kid
+		KeysDir string `yaml:"keys_dir"`
+		// ActiveKid is a kid of the signing key. If empty, the greatest kid in lexical order is used
+		ActiveKid string `yaml:"active_kid"`
+		// ReloadIntervalMilli is an interval of rereading KeysDir and PublicKeysDir, DefaultJwtReloadInterval by default
+		ReloadIntervalMilli int `yaml:"reload_interval"`
+		// Algorithms are accepted signing methods, only HS256 by default.
+		// They must include an asymmetric one, if PublicKeysDir or JWKS is set
+		Algorithms []string `yaml:"algorithms"`
+		// PublicKeysDir is a directory of pem public keys. The name of each file without extension is the kid
+		PublicKeysDir string `yaml:"public_keys_dir"`
+		// JWKS is an url or a file path of the JSON Web Key Set of the identity provider
+		JWKS string `yaml:"jwks"`
+		// JWKSRefreshIntervalMilli is an interval of refreshing JWKS, DefaultJWKSRefreshInterval by default
+		JWKSRefreshIntervalMilli int `yaml:"jwks_refresh_interval"`
+		// Issuer is a required iss of tokens, if not empty
+		Issuer string `yaml:"issuer"`
+		// Audience is a list of accepted aud of tokens, if not empty
+		Audience []string `yaml:"audience"`
+		// RequireExp rejects tokens without exp, true by default
+		RequireExp bool `yaml:"require_exp"`
+		// MaxAgeMilli rejects tokens issued earlier, if greater than zero
+		MaxAgeMilli int `yaml:"max_age"`
+		// LeewayMilli is an allowed clock skew of time claims
+		LeewayMilli int `yaml:"leeway"`
+		// AccessTokenTTlMilli is a lifetime of issued access tokens, DefaultAccessTokenTTL by default
+		AccessTokenTTlMilli int `yaml:"access_token_ttl"`
+		// RefreshTokenTTlMilli is a lifetime of issued refresh tokens, DefaultRefreshTokenTTL by default
+		RefreshTokenTTlMilli int `yaml:"refresh_token_ttl"`
+		// RevocationCacheTTlMilli is a time revocation checks are cached in memory. Zero disables the cache
+		RevocationCacheTTlMilli int `yaml:"revocation_cache_ttl"`
+		// RevocationTTlMilli is a time the token is kept revoked, if its expiration is unknown.
+		// DefaultRevocationTTL by default
+		RevocationTTlMilli int `yaml:"revocation_ttl"`
+	} `yaml:"jwt"`
+	Auth struct {
+		// Schemes are authentication schemes tried in order: AuthSchemeJwt, AuthSchemeApiKey
+		Schemes []string `yaml:"schemes"`
+	} `yaml:"auth"`
+	// RequestTimeoutMilli is a deadline of the request processing, including db and cache queries. Zero disables it
+	RequestTimeoutMilli int `yaml:"request_timeout"`
+	Shutdown            struct {
+		// DelayMilli is a time between marking the api as not ready and stopping the server,
+		// so load balancers have time to stop routing requests to the instance
+		DelayMilli int `yaml:"delay"`
+		// GracePeriodMilli is a time to finish in-flight requests, 10 seconds by default
+		GracePeriodMilli int `yaml:"grace_period"`
+	} `yaml:"shutdown"`
+	Health struct {
+		// TimeoutMilli is a timeout of each dependency check in the readiness probe, 1 second by default
+		TimeoutMilli int `yaml:"timeout"`
+	} `yaml:"health"`
+	Cache struct {
+		TTlMilli int `yaml:"ttl"`
+		// SoftTTlMilli enables stale-while-revalidate mode, if greater than zero
+		SoftTTlMilli int `yaml:"soft_ttl"`
+		// EmptyTTlMilli is a ttl of cached empty results. If zero, ttl is used
+		EmptyTTlMilli int `yaml:"empty_ttl"`
+		// UsersTTlMilli is a ttl of cached permissions of users. If zero, they are not cached
+		UsersTTlMilli int    `yaml:"users_ttl"`
+		KeyPrefix     string `yaml:"key_prefix"`
+		// FailPolicy defines behavior on cache read errors: FailPolicyOpen (default) or FailPolicyClosed
+		FailPolicy string `yaml:"fail_policy"`
+		// InvalidationChannel is a redis channel for dropping changed keys from local caches of other instances
+		InvalidationChannel string `yaml:"invalidation_channel"`
 	} `yaml:"cache"`
 	DB struct {
 		Host     string `yaml:"host"`
@@ -20,12 +89,28 @@ type Values struct {
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
 		Database string `yaml:"database"`
+		// MaxOpenConns is a max number of open connections, DefaultDBMaxOpenConns by default
+		MaxOpenConns int `yaml:"max_open_conns"`
+		// MaxIdleConns is a max number of idle connections, 2 by default
+		MaxIdleConns int `yaml:"max_idle_conns"`
+		// ConnMaxLifetimeMilli is a max time a connection may be reused. Zero means no limit
+		ConnMaxLifetimeMilli int `yaml:"conn_max_lifetime"`
+		// ConnMaxIdleTimeMilli is a max time a connection may be idle. Zero means no limit
+		ConnMaxIdleTimeMilli int `yaml:"conn_max_idle_time"`
 	} `yaml:"db"`
+	// Redis pool settings use go-redis defaults, if zero
 	Redis struct {
-		Addr     string `yaml:"addr"`
-		Db       int    `yaml:"db"`
-		Username string `yaml:"username"`
-		Password string `yaml:"password"`
+		Addr             string `yaml:"addr"`
+		Db               int    `yaml:"db"`
+		Username         string `yaml:"username"`
+		Password         string `yaml:"password"`
+		PoolSize         int    `yaml:"pool_size"`
+		MinIdleConns     int    `yaml:"min_idle_conns"`
+		ReadTimeoutMilli int    `yaml:"read_timeout"`
+		// WriteTimeoutMilli defaults to ReadTimeoutMilli
+		WriteTimeoutMilli int `yaml:"write_timeout"`
+		// MaxRetries is a max number of retries before giving up, -1 disables retries
+		MaxRetries int `yaml:"max_retries"`
 	} `yaml:"redis"`
 }
 
@@ -33,28 +118,235 @@ func (cfg Values) GetDSN() string {
 	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", cfg.DB.Host, cfg.DB.Port, cfg.DB.Username, cfg.DB.Password, cfg.DB.Database)
 }
 
+const (
+	DefaultAddr                = ":8080"
+	DefaultShutdownGracePeriod = 10 * time.Second
+	DefaultHealthTimeout       = time.Second
+)
+
+func (cfg Values) GetAddr() string {
+	if cfg.Addr != "" {
+		return cfg.Addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return DefaultAddr
+}
+
+func (cfg Values) GetShutdownDelay() time.Duration {
+	return time.Duration(cfg.Shutdown.DelayMilli) * time.Millisecond
+}
+
+func (cfg Values) GetShutdownGracePeriod() time.Duration {
+	if cfg.Shutdown.GracePeriodMilli == 0 {
+		return DefaultShutdownGracePeriod
+	}
+	return time.Duration(cfg.Shutdown.GracePeriodMilli) * time.Millisecond
+}
+
+func (cfg Values) GetHealthTimeout() time.Duration {
+	if cfg.Health.TimeoutMilli == 0 {
+		return DefaultHealthTimeout
+	}
+	return time.Duration(cfg.Health.TimeoutMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRequestTimeout() time.Duration {
+	return time.Duration(cfg.RequestTimeoutMilli) * time.Millisecond
+}
+
+const DefaultJwtReloadInterval = 10 * time.Second
+
+func (cfg Values) GetJwtReloadInterval() time.Duration {
+	if cfg.Jwt.ReloadIntervalMilli == 0 {
+		return DefaultJwtReloadInterval
+	}
+	return time.Duration(cfg.Jwt.ReloadIntervalMilli) * time.Millisecond
+}
+
+const DefaultJWKSRefreshInterval = 5 * time.Minute
+
+func (cfg Values) GetJWKSRefreshInterval() time.Duration {
+	if cfg.Jwt.JWKSRefreshIntervalMilli == 0 {
+		return DefaultJWKSRefreshInterval
+	}
+	return time.Duration(cfg.Jwt.JWKSRefreshIntervalMilli) * time.Millisecond
+}
+
+func (cfg Values) GetJwtMaxAge() time.Duration {
+	return time.Duration(cfg.Jwt.MaxAgeMilli) * time.Millisecond
+}
+
+func (cfg Values) GetJwtLeeway() time.Duration {
+	return time.Duration(cfg.Jwt.LeewayMilli) * time.Millisecond
+}
+
+const (
+	DefaultRevocationTTL   = 7 * 24 * time.Hour
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+func (cfg Values) GetAccessTokenTTL() time.Duration {
+	if cfg.Jwt.AccessTokenTTlMilli == 0 {
+		return DefaultAccessTokenTTL
+	}
+	return time.Duration(cfg.Jwt.AccessTokenTTlMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRefreshTokenTTL() time.Duration {
+	if cfg.Jwt.RefreshTokenTTlMilli == 0 {
+		return DefaultRefreshTokenTTL
+	}
+	return time.Duration(cfg.Jwt.RefreshTokenTTlMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRevocationCacheTTL() time.Duration {
+	return time.Duration(cfg.Jwt.RevocationCacheTTlMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRevocationTTL() time.Duration {
+	if cfg.Jwt.RevocationTTlMilli == 0 {
+		return DefaultRevocationTTL
+	}
+	return time.Duration(cfg.Jwt.RevocationTTlMilli) * time.Millisecond
+}
+
+const (
+	// AuthSchemeJwt authenticates "Bearer <jwt>" tokens
+	AuthSchemeJwt = "jwt"
+	// AuthSchemeApiKey authenticates "ApiKey <key>" api keys
+	AuthSchemeApiKey = "api_key"
+)
+
+// HasJwtVerificationKeys reports whether tokens can be verified by asymmetric keys
+func (cfg Values) HasJwtVerificationKeys() bool {
+	return cfg.Jwt.PublicKeysDir != "" || cfg.Jwt.JWKS != ""
+}
+
+// SupportedJwtAlgorithms can be used in Jwt.Algorithms
+var SupportedJwtAlgorithms = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+const DefaultDBMaxOpenConns = 10
+
+func (cfg Values) GetDBMaxOpenConns() int {
+	if cfg.DB.MaxOpenConns == 0 {
+		return DefaultDBMaxOpenConns
+	}
+	return cfg.DB.MaxOpenConns
+}
+
+func (cfg Values) GetDBConnMaxLifetime() time.Duration {
+	return time.Duration(cfg.DB.ConnMaxLifetimeMilli) * time.Millisecond
+}
+
+func (cfg Values) GetDBConnMaxIdleTime() time.Duration {
+	return time.Duration(cfg.DB.ConnMaxIdleTimeMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRedisReadTimeout() time.Duration {
+	return time.Duration(cfg.Redis.ReadTimeoutMilli) * time.Millisecond
+}
+
+func (cfg Values) GetRedisWriteTimeout() time.Duration {
+	return time.Duration(cfg.Redis.WriteTimeoutMilli) * time.Millisecond
+}
+
 func (cfg Values) GetCacheTTL() time.Duration {
 	return time.Duration(cfg.Cache.TTlMilli) * time.Millisecond
 }
 
-const DefaultConfigPath = "./config/database-service/config.yml"
+func (cfg Values) GetCacheSoftTTL() time.Duration {
+	return time.Duration(cfg.Cache.SoftTTlMilli) * time.Millisecond
+}
+
+func (cfg Values) GetCacheEmptyTTL() time.Duration {
+	return time.Duration(cfg.Cache.EmptyTTlMilli) * time.Millisecond
+}
+
+// DefaultCacheUsersTTL bounds staleness of permissions, if an invalidation notification is lost
+const DefaultCacheUsersTTL = 30 * time.Second
+
+func (cfg Values) GetCacheUsersTTL() time.Duration {
+	return time.Duration(cfg.Cache.UsersTTlMilli) * time.Millisecond
+}
+
+const (
+	// FailPolicyOpen falls back to db on cache errors
+	FailPolicyOpen = "open"
+	// FailPolicyClosed fails requests on cache errors, protecting db from the load
+	FailPolicyClosed = "closed"
+)
+
+func (cfg Values) IsCacheFailClosed() bool {
+	return cfg.Cache.FailPolicy == FailPolicyClosed
+}
 
+func (cfg Values) GetInvalidationChannel() string {
+	if cfg.Cache.InvalidationChannel != "" {
+		return cfg.Cache.InvalidationChannel
+	}
+	return cfg.Cache.KeyPrefix + "_invalidation"
+}
+
+const (
+	DefaultConfigPath = "./config/database-service/config.yml"
+	// EnvPrefix is a prefix of environment variables overriding config fields.
+	// The name of the variable is built from yaml keys, e.g. DBSERVICE_DB_PASSWORD for db.password.
+	// The value is read from the file, if the name has EnvFileSuffix, e.g. DBSERVICE_DB_PASSWORD_FILE
+	EnvPrefix     = "DBSERVICE"
+	EnvFileSuffix = "_FILE"
+)
+
+// Default returns config values used when neither the file nor the environment sets them
+func Default() *Values {
+	cfg := &Values{}
+	cfg.Shutdown.GracePeriodMilli = int(DefaultShutdownGracePeriod / time.Millisecond)
+	cfg.Health.TimeoutMilli = int(DefaultHealthTimeout / time.Millisecond)
+	cfg.Cache.FailPolicy = FailPolicyOpen
+	cfg.Cache.UsersTTlMilli = int(DefaultCacheUsersTTL / time.Millisecond)
+	cfg.DB.MaxOpenConns = DefaultDBMaxOpenConns
+	cfg.Jwt.ReloadIntervalMilli = int(DefaultJwtReloadInterval / time.Millisecond)
+	cfg.Jwt.JWKSRefreshIntervalMilli = int(DefaultJWKSRefreshInterval / time.Millisecond)
+	cfg.Jwt.RequireExp = true
+	cfg.Auth.Schemes = []string{AuthSchemeJwt, AuthSchemeApiKey}
+	return cfg
+}
+
+// ReadConfig layers defaults, the yaml file and environment variables, then validates the result.
+// The file is optional, unless CONFIG_PATH is set
 func ReadConfig() (config *Values, err error) {
-	path := os.Getenv("CONFIG_PATH")
-	if path == "" {
+	config = Default()
+	path, explicit := os.LookupEnv("CONFIG_PATH")
+	if !explicit || path == "" {
 		path = DefaultConfigPath
 	}
 	abs, err := filepath.Abs(path)
 	if err != nil {
-		return
+		return nil, err
 	}
 	file, err := os.ReadFile(abs)
-	if err != nil {
-		return
+	switch {
+	case err == nil:
+		if err = yaml.Unmarshal(file, config); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist) && !explicit:
+	default:
+		return nil, err
 	}
-	err = yaml.Unmarshal(file, &config)
-	if err != nil {
-		return
+	if err = config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
 	}
 	return config, nil
 }
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validConfig() *Values {
+	cfg := Default()
+	cfg.JwtCodePhrase = "phrase"
+	cfg.Cache.KeyPrefix = "database-service"
+	cfg.DB.Host = "postgres"
+	cfg.DB.Port = "5432"
+	cfg.DB.Username = "database-service"
+	cfg.DB.Database = "users_data"
+	cfg.Redis.Addr = "redis:6379"
+	return cfg
+}
+
+func lookupMap(env map[string]string) LookupEnvFunc {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestValues_ApplyEnv(t *testing.T) {
+	cfg := validConfig()
+	err := cfg.ApplyEnv(lookupMap(map[string]string{
+		"DBSERVICE_DB_PASSWORD":       "secret",
+		"DBSERVICE_JWT_CODE_PHRASE":   "env-phrase",
+		"DBSERVICE_CACHE_TTL":         "5000",
+		"DBSERVICE_REDIS_MAX_RETRIES": "-1",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", cfg.DB.Password)
+	assert.Equal(t, "env-phrase", cfg.JwtCodePhrase)
+	assert.Equal(t, 5000, cfg.Cache.TTlMilli)
+	assert.Equal(t, -1, cfg.Redis.MaxRetries)
+	assert.Equal(t, "postgres", cfg.DB.Host)
+}
+
+func TestValues_ApplyEnv_InvalidValue(t *testing.T) {
+	cfg := validConfig()
+	err := cfg.ApplyEnv(lookupMap(map[string]string{
+		"DBSERVICE_CACHE_TTL":    "1s",
+		"DBSERVICE_REDIS_DB":     "one",
+		"DBSERVICE_DB_HOST":      "db",
+		"DBSERVICE_UNKNOWN_NAME": "1",
+	}))
+	assert.ErrorContains(t, err, "DBSERVICE_CACHE_TTL")
+	assert.ErrorContains(t, err, "DBSERVICE_REDIS_DB")
+	assert.Equal(t, "db", cfg.DB.Host)
+}
+
+func TestEnvNames(t *testing.T) {
+	names := EnvNames()
+	assert.Contains(t, names, "DBSERVICE_DB_PASSWORD")
+	assert.Contains(t, names, "DBSERVICE_SHUTDOWN_GRACE_PERIOD")
+	assert.Contains(t, names, "DBSERVICE_CACHE_KEY_PREFIX")
+}
+
+func TestValues_Validate(t *testing.T) {
+	assert.Nil(t, validConfig().Validate())
+
+	cfg := Default()
+	cfg.DB.Port = "postgres"
+	cfg.Cache.FailPolicy = "sometimes"
+	cfg.Cache.TTlMilli = -1
+	cfg.Cache.EmptyTTlMilli = 500
+	cfg.Auth.Schemes = []string{"jwt", "basic"}
+	err := cfg.Validate()
+
+	var fields []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var fieldErr FieldError
+		if assert.True(t, errors.As(e, &fieldErr)) {
+			fields = append(fields, fieldErr.Field)
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"jwt_code_phrase", "cache.ttl", "cache.empty_ttl", "cache.key_prefix", "cache.fail_policy",
+		"db.host", "db.port", "db.username", "db.database", "redis.addr", "auth.schemes",
+	}, fields)
+}
+
+func TestValues_Validate_JwtAlgorithms(t *testing.T) {
+	cfg := validConfig()
+	cfg.Jwt.JWKS = "https://idp.example.com/.well-known/jwks.json"
+	assert.ErrorContains(t, cfg.Validate(), "jwt.algorithms must include an asymmetric algorithm")
+
+	cfg.Jwt.Algorithms = []string{"HS256"}
+	assert.ErrorContains(t, cfg.Validate(), "jwt.algorithms must include an asymmetric algorithm")
+
+	cfg.Jwt.Algorithms = []string{"HS256", "RS256"}
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestValues_Validate_CacheTTL(t *testing.T) {
+	cfg := validConfig()
+	cfg.Cache.TTlMilli = 0
+	cfg.Cache.SoftTTlMilli = 0
+	cfg.Cache.EmptyTTlMilli = 0
+	cfg.Cache.UsersTTlMilli = 0
+	assert.Nil(t, cfg.Validate())
+
+	cfg.Cache.TTlMilli = 999
+	cfg.Cache.UsersTTlMilli = 1
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "cache.ttl must be 0 or at least 1000 ms")
+	assert.ErrorContains(t, err, "cache.users_ttl must be 0 or at least 1000 ms")
+
+	cfg.Cache.TTlMilli = 5000
+	cfg.Cache.UsersTTlMilli = 1000
+	cfg.Cache.SoftTTlMilli = 5000
+	assert.ErrorContains(t, cfg.Validate(), "cache.soft_ttl must be less than cache.ttl")
+
+	cfg.Cache.SoftTTlMilli = 1000
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestReadConfig_Layering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	file := `
+jwt_code_phrase: "file-phrase"
+cache:
+  key_prefix: "database-service"
+db:
+  host: "postgres"
+  port: "5432"
+  username: "database-service"
+  password: "file-password"
+  database: "users_data"
+redis:
+  addr: "redis:6379"
+`
+	assert.Nil(t, os.WriteFile(path, []byte(file), 0o600))
+	t.Setenv("CONFIG_PATH", path)
+	t.Setenv("DBSERVICE_DB_PASSWORD", "env-password")
+
+	cfg, err := ReadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "env-password", cfg.DB.Password)
+	assert.Equal(t, "file-phrase", cfg.JwtCodePhrase)
+	assert.Equal(t, DefaultAddr, cfg.GetAddr())
+	assert.Equal(t, DefaultDBMaxOpenConns, cfg.DB.MaxOpenConns)
+}
+
+func TestValues_GetAddr(t *testing.T) {
+	cfg := validConfig()
+	t.Setenv("PORT", "")
+	assert.Equal(t, DefaultAddr, cfg.GetAddr())
+
+	t.Setenv("PORT", "9000")
+	assert.Equal(t, ":9000", cfg.GetAddr())
+
+	cfg.Addr = "127.0.0.1:8081"
+	assert.Equal(t, "127.0.0.1:8081", cfg.GetAddr())
+}
+
+func TestReadConfig_MissingExplicitFile(t *testing.T) {
+	t.Setenv("CONFIG_PATH", filepath.Join(t.TempDir(), "missing.yml"))
+	_, err := ReadConfig()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestValues_ApplyEnv_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(path, []byte("file-secret\n"), 0o600))
+
+	cfg := validConfig()
+	err := cfg.ApplyEnv(lookupMap(map[string]string{
+		"DBSERVICE_DB_PASSWORD_FILE":     path,
+		"DBSERVICE_JWT_CODE_PHRASE":      "env-phrase",
+		"DBSERVICE_JWT_CODE_PHRASE_FILE": path,
+		"DBSERVICE_REDIS_PASSWORD_FILE":  filepath.Join(t.TempDir(), "missing"),
+	}))
+	assert.ErrorContains(t, err, "DBSERVICE_REDIS_PASSWORD_FILE")
+	assert.Equal(t, "file-secret", cfg.DB.Password)
+	assert.Equal(t, "env-phrase", cfg.JwtCodePhrase)
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// LookupEnvFunc has the signature of os.LookupEnv
+type LookupEnvFunc func(key string) (string, bool)
+
+// ApplyEnv overrides every field, which has a matching environment variable
+func (cfg *Values) ApplyEnv(lookup LookupEnvFunc) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), EnvPrefix, lookup)
+}
+
+// EnvNames returns names of all environment variables, which can override the config
+func EnvNames() (names []string) {
+	walkEnv(reflect.TypeOf(Values{}), EnvPrefix, func(name string, _ []int) {
+		names = append(names, name)
+	})
+	return
+}
+
+func envName(prefix string, field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "" {
+		key = field.Name
+	}
+	return prefix + "_" + strings.ToUpper(key)
+}
+
+func walkEnv(t reflect.Type, prefix string, fn func(name string, index []int)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("yaml") == "-" {
+			continue
+		}
+		name := envName(prefix, field)
+		if field.Type.Kind() == reflect.Struct {
+			walkEnv(field.Type, name, func(name string, index []int) {
+				fn(name, append([]int{i}, index...))
+			})
+			continue
+		}
+		fn(name, []int{i})
+	}
+}
+
+func applyEnv(v reflect.Value, prefix string, lookup LookupEnvFunc) error {
+	var errs []error
+	walkEnv(v.Type(), prefix, func(name string, index []int) {
+		value, ok := lookup(name)
+		if path, isFile := lookup(name + EnvFileSuffix); isFile && !ok {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name+EnvFileSuffix, err))
+				return
+			}
+			// secrets are usually written with the trailing newline
+			value, ok = strings.TrimRight(string(content), "\r\n"), true
+		}
+		if !ok {
+			return
+		}
+		if err := setField(v.FieldByIndex(index), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MinCacheTTLMilli is the shortest ttl supported by redis entries of go-redis/cache
+const MinCacheTTLMilli = 1000
+
+// FieldError describes a missing or invalid config field
+type FieldError struct {
+	// Field is a yaml path of the field, e.g. db.password
+	Field  string
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("config: %s %s", e.Field, e.Reason)
+}
+
+// Validate checks the whole config and returns every missing or invalid field joined in one error
+func (cfg *Values) Validate() error {
+	var errs []error
+	required := func(field, value string) {
+		if value == "" {
+			errs = append(errs, FieldError{Field: field, Reason: "is required"})
+		}
+	}
+	nonNegative := func(field string, value int) {
+		if value < 0 {
+			errs = append(errs, FieldError{Field: field, Reason: "must not be negative"})
+		}
+	}
+	// cacheTTL checks ttl of redis entries: go-redis/cache replaces a ttl shorter than a second with an hour
+	cacheTTL := func(field string, value int) {
+		if value != 0 && value < MinCacheTTLMilli {
+			errs = append(errs, FieldError{Field: field, Reason: fmt.Sprintf("must be 0 or at least %d ms", MinCacheTTLMilli)})
+		}
+	}
+
+	if cfg.Jwt.KeysDir == "" && !cfg.HasJwtVerificationKeys() {
+		required("jwt_code_phrase", cfg.JwtCodePhrase)
+	}
+	nonNegative("jwt.reload_interval", cfg.Jwt.ReloadIntervalMilli)
+	nonNegative("jwt.jwks_refresh_interval", cfg.Jwt.JWKSRefreshIntervalMilli)
+	nonNegative("jwt.max_age", cfg.Jwt.MaxAgeMilli)
+	nonNegative("jwt.leeway", cfg.Jwt.LeewayMilli)
+	nonNegative("jwt.access_token_ttl", cfg.Jwt.AccessTokenTTlMilli)
+	nonNegative("jwt.refresh_token_ttl", cfg.Jwt.RefreshTokenTTlMilli)
+	nonNegative("jwt.revocation_cache_ttl", cfg.Jwt.RevocationCacheTTlMilli)
+	nonNegative("jwt.revocation_ttl", cfg.Jwt.RevocationTTlMilli)
+	for _, alg := range cfg.Jwt.Algorithms {
+		if !slices.Contains(SupportedJwtAlgorithms, alg) {
+			errs = append(errs, FieldError{Field: "jwt.algorithms", Reason: fmt.Sprintf("has unsupported algorithm %q", alg)})
+		}
+	}
+	// the default algorithms are HMAC only, so tokens signed with public keys would all be rejected
+	if cfg.HasJwtVerificationKeys() && !slices.ContainsFunc(cfg.Jwt.Algorithms, func(alg string) bool {
+		return !strings.HasPrefix(alg, "HS")
+	}) {
+		errs = append(errs, FieldError{Field: "jwt.algorithms", Reason: "must include an asymmetric algorithm, if jwt.public_keys_dir or jwt.jwks is set"})
+	}
+	if len(cfg.Auth.Schemes) == 0 {
+		errs = append(errs, FieldError{Field: "auth.schemes", Reason: "is required"})
+	}
+	for _, scheme := range cfg.Auth.Schemes {
+		if scheme != AuthSchemeJwt && scheme != AuthSchemeApiKey {
+			errs = append(errs, FieldError{Field: "auth.schemes", Reason: fmt.Sprintf("has unsupported scheme %q", scheme)})
+		}
+	}
+	nonNegative("request_timeout", cfg.RequestTimeoutMilli)
+	nonNegative("shutdown.delay", cfg.Shutdown.DelayMilli)
+	nonNegative("shutdown.grace_period", cfg.Shutdown.GracePeriodMilli)
+	nonNegative("health.timeout", cfg.Health.TimeoutMilli)
+
+	cacheTTL("cache.ttl", cfg.Cache.TTlMilli)
+	cacheTTL("cache.soft_ttl", cfg.Cache.SoftTTlMilli)
+	cacheTTL("cache.empty_ttl", cfg.Cache.EmptyTTlMilli)
+	cacheTTL("cache.users_ttl", cfg.Cache.UsersTTlMilli)
+	if cfg.Cache.SoftTTlMilli > 0 && cfg.Cache.TTlMilli > 0 && cfg.Cache.SoftTTlMilli >= cfg.Cache.TTlMilli {
+		errs = append(errs, FieldError{Field: "cache.soft_ttl", Reason: "must be less than cache.ttl"})
+	}
+	required("cache.key_prefix", cfg.Cache.KeyPrefix)
+	switch cfg.Cache.FailPolicy {
+	case "", FailPolicyOpen, FailPolicyClosed:
+	default:
+		errs = append(errs, FieldError{
+			Field:  "cache.fail_policy",
+			Reason: fmt.Sprintf("must be %q or %q, got %q", FailPolicyOpen, FailPolicyClosed, cfg.Cache.FailPolicy),
+		})
+	}
+
+	required("db.host", cfg.DB.Host)
+	required("db.port", cfg.DB.Port)
+	if _, err := strconv.ParseUint(cfg.DB.Port, 10, 16); cfg.DB.Port != "" && err != nil {
+		errs = append(errs, FieldError{Field: "db.port", Reason: "must be a port number"})
+	}
+	required("db.username", cfg.DB.Username)
+	required("db.database", cfg.DB.Database)
+	nonNegative("db.max_open_conns", cfg.DB.MaxOpenConns)
+	nonNegative("db.max_idle_conns", cfg.DB.MaxIdleConns)
+	nonNegative("db.conn_max_lifetime", cfg.DB.ConnMaxLifetimeMilli)
+	nonNegative("db.conn_max_idle_time", cfg.DB.ConnMaxIdleTimeMilli)
+
+	required("redis.addr", cfg.Redis.Addr)
+	nonNegative("redis.db", cfg.Redis.Db)
+	nonNegative("redis.pool_size", cfg.Redis.PoolSize)
+	nonNegative("redis.min_idle_conns", cfg.Redis.MinIdleConns)
+	nonNegative("redis.read_timeout", cfg.Redis.ReadTimeoutMilli)
+	nonNegative("redis.write_timeout", cfg.Redis.WriteTimeoutMilli)
+	if cfg.Redis.MaxRetries < -1 {
+		errs = append(errs, FieldError{Field: "redis.max_retries", Reason: "must be -1 or greater"})
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,292 @@
+package controller
+
+import (
+	"context"
+	"database-service/auth"
+	"database-service/dbservice/api/logger"
+	"database-service/dbservice/api/response"
+	"database-service/dbservice/api/services"
+	"database-service/domain"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AuthController struct {
+	logger            logger.Logger
+	authService       auth.Service
+	revocationService services.Revocation
+	tokenService      services.Tokens
+	apiKeyService     services.ApiKeys
+}
+
+func NewAuthController(authService auth.Service, revocationService services.Revocation, tokenService services.Tokens,
+	apiKeyService services.ApiKeys, logger logger.Logger) *AuthController {
+	return &AuthController{
+		authService:       authService,
+		revocationService: revocationService,
+		tokenService:      tokenService,
+		apiKeyService:     apiKeyService,
+		logger:            logger,
+	}
+}
+
+func (controller *AuthController) AddRoutes(router gin.IRoutes) {
+	router.POST("/auth/token", controller.IssueTokenHandler)
+	router.POST("/auth/refresh", controller.RefreshTokenHandler)
+	router.POST("/auth/revoke", controller.RevokeHandler)
+	router.POST("/auth/api-keys", controller.CreateApiKeyHandler)
+	router.DELETE("/auth/api-keys/:id", controller.RevokeApiKeyHandler)
+}
+
+type ApiKeyRequest struct {
+	// UserId is an owner of the key. If not set, the key is created for the requested user
+	UserId    int        `json:"user_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ApiKeyResponse struct {
+	Id     int `json:"id"`
+	UserId int `json:"user_id"`
+	// Key is returned only once, when the key is created
+	Key       string     `json:"key,omitempty"`
+	Prefix    string     `json:"prefix"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type TokenRequest struct {
+	// UserId is a user the tokens are issued for. If not set, tokens are issued for the requested user
+	UserId int `json:"user_id"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is a lifetime of the access token in seconds
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	// RefreshExpiresIn is a lifetime of the refresh token in seconds
+	RefreshExpiresIn int `json:"refresh_expires_in"`
+}
+
+// RevokeRequest revokes either the token by Jti or all tokens of the user by UserId
+type RevokeRequest struct {
+	Jti string `json:"jti"`
+	// ExpiresAt is an expiration time of the token, revocation is kept until it. Optional
+	ExpiresAt *time.Time `json:"expires_at"`
+	UserId    int        `json:"user_id"`
+}
+
+func (controller *AuthController) IssueTokenHandler(ctx *gin.Context) {
+	var request TokenRequest
+	// the body is optional
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			writeResponse(ctx, badRequest(err))
+			return
+		}
+	}
+	writeResponse(ctx, controller.IssueToken(ctx.Request.Context(), ctx.GetHeader("Authorization"), request))
+}
+
+func (controller *AuthController) RefreshTokenHandler(ctx *gin.Context) {
+	var request RefreshRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.RefreshToken(ctx.Request.Context(), request))
+}
+
+func (controller *AuthController) CreateApiKeyHandler(ctx *gin.Context) {
+	var request ApiKeyRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.CreateApiKey(ctx.Request.Context(), ctx.GetHeader("Authorization"), request))
+}
+
+func (controller *AuthController) RevokeApiKeyHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	writeResponse(ctx, controller.RevokeApiKey(ctx.Request.Context(), ctx.GetHeader("Authorization"), id))
+}
+
+func (controller *AuthController) RevokeHandler(ctx *gin.Context) {
+	var request RevokeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.Revoke(ctx.Request.Context(), ctx.GetHeader("Authorization"), request))
+}
+
+func (controller *AuthController) IssueToken(ctx context.Context, bearerToken string, request TokenRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	subjectId := request.UserId
+	if subjectId == 0 {
+		subjectId = claims.UserID
+	}
+	pair, err := controller.tokenService.IssueTokens(ctx, claims, subjectId)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newTokenResponse(pair),
+	}
+}
+
+func (controller *AuthController) RefreshToken(ctx context.Context, request RefreshRequest) response.Response {
+	pair, err := controller.tokenService.RefreshTokens(ctx, request.RefreshToken)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newTokenResponse(pair),
+	}
+}
+
+func (controller *AuthController) Revoke(ctx context.Context, bearerToken string, request RevokeRequest) response.Response {
+	if (request.Jti == "") == (request.UserId == 0) {
+		return badRequest(errors.New("either jti or user_id must be set"))
+	}
+
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	if request.Jti != "" {
+		var expiresAt time.Time
+		if request.ExpiresAt != nil {
+			expiresAt = *request.ExpiresAt
+		}
+		err = controller.revocationService.RevokeToken(ctx, claims, request.Jti, expiresAt)
+		if err == nil {
+			// refresh tokens issued by the revoked token would issue new access tokens
+			err = controller.tokenService.RevokeIssuedBy(ctx, request.Jti)
+		}
+	} else {
+		err = controller.revocationService.RevokeUserTokens(ctx, claims, request.UserId)
+	}
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusNoContent,
+		Body:   nil,
+	}
+}
+
+func (controller *AuthController) CreateApiKey(ctx context.Context, bearerToken string, request ApiKeyRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	ownerId := request.UserId
+	if ownerId == 0 {
+		ownerId = claims.UserID
+	}
+	key, created, err := controller.apiKeyService.CreateApiKey(ctx, claims, ownerId, request.Name, request.Scopes, request.ExpiresAt)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	body := newApiKeyResponse(created)
+	body.Key = key
+	return response.Response{
+		Status: http.StatusCreated,
+		Body:   body,
+	}
+}
+
+func (controller *AuthController) RevokeApiKey(ctx context.Context, bearerToken string, id int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	if err = controller.apiKeyService.RevokeApiKey(ctx, claims, id); err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusNoContent,
+		Body:   nil,
+	}
+}
+
+// errorResponse maps errors of the services to response statuses
+func (controller *AuthController) errorResponse(err error) response.Response {
+	if resp, ok := usersErrorResponse(controller.logger, err); ok {
+		return resp
+	}
+	switch {
+	case errors.Is(err, services.ErrForbidden), errors.Is(err, services.ErrDerivedCredentials):
+		return response.Response{Status: http.StatusForbidden, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, domain.ErrUserNotFound), errors.Is(err, domain.ErrApiKeyNotFound):
+		return response.Response{Status: http.StatusNotFound, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, services.ErrInvalidRefreshToken), errors.Is(err, services.ErrRefreshTokenReused):
+		controller.logger.Error(err)
+		return response.Response{Status: http.StatusUnauthorized, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, auth.ErrRevocationUnavailable):
+		controller.logger.Error(err)
+		return response.Response{Status: http.StatusServiceUnavailable, Body: gin.H{"error": auth.ErrRevocationUnavailable.Error()}}
+	}
+	controller.logger.Error(err)
+	return response.Response{
+		Status: http.StatusInternalServerError,
+		Body:   nil,
+	}
+}
+
+func newTokenResponse(pair services.TokenPair) TokenResponse {
+	return TokenResponse{
+		AccessToken:      pair.AccessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(time.Until(pair.AccessExpiresAt).Seconds()),
+		RefreshToken:     pair.RefreshToken,
+		RefreshExpiresIn: int(time.Until(pair.RefreshExpiresAt).Seconds()),
+	}
+}
+
+func newApiKeyResponse(key domain.ApiKey) ApiKeyResponse {
+	return ApiKeyResponse{
+		Id:        key.Id,
+		UserId:    key.UserId,
+		Prefix:    key.Prefix,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		ExpiresAt: key.ExpiresAt,
+		CreatedAt: key.CreatedAt,
+	}
+}
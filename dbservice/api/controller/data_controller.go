@@ -1,12 +1,17 @@
 package controller
 
 import (
+	"context"
 	"database-service/auth"
 	"database-service/dbservice/api/logger"
 	"database-service/dbservice/api/response"
 	"database-service/dbservice/api/services"
+	"database-service/domain"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
 )
 
 type DataController struct {
@@ -17,14 +22,23 @@ type DataController struct {
 
 func (controller *DataController) AddRoutes(router gin.IRoutes) {
 	router.GET("/data", controller.GetDataHandler)
+	router.GET("/data/:id", controller.GetDataByIdHandler)
+	router.POST("/data", controller.CreateDataHandler)
+	router.PUT("/data/:id", controller.UpdateDataHandler)
+	router.DELETE("/data/:id", controller.DeleteDataHandler)
 }
 
 func NewDataController(authService auth.Service, dataService services.Data, logger logger.Logger) *DataController {
 	return &DataController{authService: authService, dataService: dataService, logger: logger}
 }
 
+const MaxPageLimit = 1000
+
 type ResponseBody struct {
 	Data []Data `json:"data"`
+	// NextCursor is an after_id for the next page. Returned only for paginated requests, if there may be more data.
+	// Requests of GET /data are always paginated
+	NextCursor *int `json:"next_cursor,omitempty"`
 }
 
 type Data struct {
@@ -33,42 +47,163 @@ type Data struct {
 	Data   string `json:"data"`
 }
 
+type DataRequest struct {
+	// UserId is an owner of the created record. If not set, record is created for the requested user
+	UserId int    `json:"user_id"`
+	Data   string `json:"data" binding:"required"`
+}
+
+// GetDataHandler returns the first page of MaxPageLimit records, if limit and after_id are not passed,
+// so the whole table is never loaded by a single request
 func (controller *DataController) GetDataHandler(ctx *gin.Context) {
-	resp := controller.GetData(ctx.GetHeader("Authorization"))
+	writeResponse(ctx, controller.getDataPageFromQuery(ctx))
+}
+
+func (controller *DataController) GetDataByIdHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	writeResponse(ctx, controller.GetDataById(ctx.Request.Context(), ctx.GetHeader("Authorization"), id))
+}
+
+func (controller *DataController) CreateDataHandler(ctx *gin.Context) {
+	var request DataRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.CreateData(ctx.Request.Context(), ctx.GetHeader("Authorization"), request))
+}
+
+func (controller *DataController) UpdateDataHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	var request DataRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.UpdateData(ctx.Request.Context(), ctx.GetHeader("Authorization"), id, request))
+}
+
+func (controller *DataController) DeleteDataHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	writeResponse(ctx, controller.DeleteData(ctx.Request.Context(), ctx.GetHeader("Authorization"), id))
+}
+
+func writeResponse(ctx *gin.Context, resp response.Response) {
 	if resp.Body == nil {
 		ctx.Status(resp.Status)
 	}
 	ctx.JSON(resp.Status, resp.Body)
 }
 
-func (controller *DataController) GetData(bearerToken string) response.Response {
-	claims, err := controller.authService.GetClaims(bearerToken)
+// authErrors are reported to the client without details of the wrapped error
+var authErrors = []error{
+	auth.ErrInvalidTokenFormat,
+	auth.ErrInvalidToken,
+	auth.ErrTokenExpired,
+	auth.ErrTokenNotValidYet,
+	auth.ErrTokenTooOld,
+	auth.ErrMissingClaim,
+	auth.ErrInvalidIssuer,
+	auth.ErrInvalidAudience,
+	auth.ErrTokenRevoked,
+}
+
+// unauthorized maps errors of auth.Service to 401, except of unavailable revocation list or credentials
+func unauthorized(err error) response.Response {
+	for _, unavailableErr := range []error{auth.ErrRevocationUnavailable, auth.ErrCredentialsUnavailable} {
+		if errors.Is(err, unavailableErr) {
+			return response.Response{
+				Status: http.StatusServiceUnavailable,
+				Body:   gin.H{"error": unavailableErr.Error()},
+			}
+		}
+	}
+	message := err.Error()
+	for _, authErr := range authErrors {
+		if errors.Is(err, authErr) {
+			message = authErr.Error()
+			break
+		}
+	}
+	return response.Response{
+		Status: http.StatusUnauthorized,
+		Body:   gin.H{"error": message},
+	}
+}
+
+func badRequest(err error) response.Response {
+	return response.Response{
+		Status: http.StatusBadRequest,
+		Body:   gin.H{"error": err.Error()},
+	}
+}
+
+// GetData returns all records available to the user. It is not exposed by the router, since admins would load the whole table
+func (controller *DataController) GetData(ctx context.Context, bearerToken string) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
 	if err != nil {
 		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	data, err := controller.dataService.GetDataByAccessLevel(ctx, claims)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newResponseBody(data),
+	}
+}
+
+func (controller *DataController) getDataPageFromQuery(ctx *gin.Context) response.Response {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(MaxPageLimit)))
+	if err != nil || limit < 1 || limit > MaxPageLimit {
 		return response.Response{
-			Status: http.StatusUnauthorized,
-			Body:   gin.H{"error": err.Error()},
+			Status: http.StatusBadRequest,
+			Body:   gin.H{"error": fmt.Sprintf("limit must be an integer between 1 and %d", MaxPageLimit)},
 		}
 	}
+	afterId, err := strconv.Atoi(ctx.DefaultQuery("after_id", "0"))
+	if err != nil || afterId < 0 {
+		return response.Response{
+			Status: http.StatusBadRequest,
+			Body:   gin.H{"error": "after_id must be a non-negative integer"},
+		}
+	}
+	return controller.GetDataPage(ctx.Request.Context(), ctx.GetHeader("Authorization"), afterId, limit)
+}
 
-	data, err := controller.dataService.GetDataByAccessLevel(claims.UserID)
+// GetDataPage returns at most limit records with id greater than afterId.
+func (controller *DataController) GetDataPage(ctx context.Context, bearerToken string, afterId int, limit int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
 	if err != nil {
 		controller.logger.Error(err)
-		return response.Response{
-			Status: http.StatusInternalServerError,
-			Body:   nil,
-		}
+		return unauthorized(err)
 	}
 
-	var body ResponseBody
+	data, err := controller.dataService.GetDataPageByAccessLevel(ctx, claims, afterId, limit)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
 
-	body.Data = make([]Data, 0)
-	for _, item := range data {
-		body.Data = append(body.Data, Data{
-			Id:     item.GetId(),
-			UserId: item.GetUserId(),
-			Data:   item.GetData(),
-		})
+	body := newResponseBody(data)
+	if len(data) == limit {
+		nextCursor := data[len(data)-1].GetId()
+		body.NextCursor = &nextCursor
 	}
 
 	return response.Response{
@@ -76,3 +211,134 @@ func (controller *DataController) GetData(bearerToken string) response.Response
 		Body:   body,
 	}
 }
+
+func (controller *DataController) GetDataById(ctx context.Context, bearerToken string, id int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	data, err := controller.dataService.GetDataById(ctx, claims, id)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newData(data),
+	}
+}
+
+func (controller *DataController) CreateData(ctx context.Context, bearerToken string, request DataRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	ownerId := request.UserId
+	if ownerId == 0 {
+		ownerId = claims.UserID
+	}
+
+	data, err := controller.dataService.CreateData(ctx, claims, ownerId, request.Data)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusCreated,
+		Body:   newData(data),
+	}
+}
+
+func (controller *DataController) UpdateData(ctx context.Context, bearerToken string, id int, request DataRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	data, err := controller.dataService.UpdateData(ctx, claims, id, request.Data)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newData(data),
+	}
+}
+
+func (controller *DataController) DeleteData(ctx context.Context, bearerToken string, id int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	_, err = controller.dataService.DeleteData(ctx, claims, id)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusNoContent,
+		Body:   nil,
+	}
+}
+
+// errorResponse maps errors of the services to response statuses
+func (controller *DataController) errorResponse(err error) response.Response {
+	if resp, ok := usersErrorResponse(controller.logger, err); ok {
+		return resp
+	}
+	switch {
+	case errors.Is(err, domain.ErrDataNotFound):
+		return response.Response{Status: http.StatusNotFound, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, domain.ErrDataOwnerNotFound):
+		return response.Response{Status: http.StatusBadRequest, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, services.ErrForbidden):
+		return response.Response{Status: http.StatusForbidden, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, domain.ErrCacheUnavailable):
+		controller.logger.Error(err)
+		return response.Response{Status: http.StatusServiceUnavailable, Body: gin.H{"error": domain.ErrCacheUnavailable.Error()}}
+	}
+	controller.logger.Error(err)
+	return response.Response{
+		Status: http.StatusInternalServerError,
+		Body:   nil,
+	}
+}
+
+// usersErrorResponse maps errors of resolving the user of the token: unknown user to 401 and unavailable users to 503
+func usersErrorResponse(logger logger.Logger, err error) (response.Response, bool) {
+	switch {
+	case errors.Is(err, services.ErrUnknownUser):
+		logger.Error(err)
+		return response.Response{Status: http.StatusUnauthorized, Body: gin.H{"error": services.ErrUnknownUser.Error()}}, true
+	case errors.Is(err, services.ErrUsersUnavailable):
+		logger.Error(err)
+		return response.Response{Status: http.StatusServiceUnavailable, Body: gin.H{"error": services.ErrUsersUnavailable.Error()}}, true
+	}
+	return response.Response{}, false
+}
+
+func newData(item domain.Data) Data {
+	return Data{
+		Id:     item.GetId(),
+		UserId: item.GetUserId(),
+		Data:   item.GetData(),
+	}
+}
+
+func newResponseBody(data []domain.Data) ResponseBody {
+	var body ResponseBody
+
+	body.Data = make([]Data, 0)
+	for _, item := range data {
+		body.Data = append(body.Data, newData(item))
+	}
+	return body
+}
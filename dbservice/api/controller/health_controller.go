@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"database-service/dbservice/api/logger"
+	"database-service/dbservice/api/response"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusReady    = "ready"
+	StatusDegraded = "degraded"
+	StatusNotReady = "not_ready"
+)
+
+// Pinger checks the availability of the dependency
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PingerFunc is an adapter to use functions as Pinger
+type PingerFunc func(ctx context.Context) error
+
+func (f PingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+type HealthController struct {
+	db            Pinger
+	cache         Pinger
+	isReady       func() bool
+	timeout       time.Duration
+	cacheRequired bool
+	logger        logger.Logger
+}
+
+// NewHealthController creates controller of liveness and readiness probes. Each dependency is pinged with the timeout.
+// cacheRequired makes the api not ready without cache, e.g. when reads fail on cache errors
+func NewHealthController(db Pinger, cache Pinger, isReady func() bool, timeout time.Duration, cacheRequired bool,
+	logger logger.Logger) *HealthController {
+	return &HealthController{db: db, cache: cache, isReady: isReady, timeout: timeout, cacheRequired: cacheRequired, logger: logger}
+}
+
+func (controller *HealthController) AddRoutes(router gin.IRoutes) {
+	router.GET(LivenessPath, controller.LivenessHandler)
+	router.GET(ReadinessPath, controller.ReadinessHandler)
+}
+
+type HealthResponseBody struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is a status of the dependency. Errors are only logged, since the probe is not authenticated
+type CheckResult struct {
+	Status string `json:"status"`
+}
+
+func (controller *HealthController) LivenessHandler(ctx *gin.Context) {
+	writeResponse(ctx, controller.Liveness())
+}
+
+func (controller *HealthController) ReadinessHandler(ctx *gin.Context) {
+	writeResponse(ctx, controller.Readiness(ctx.Request.Context()))
+}
+
+// Liveness reports that the process is alive
+func (controller *HealthController) Liveness() response.Response {
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   HealthResponseBody{Status: StatusUp},
+	}
+}
+
+// Readiness checks db and cache. The api is not ready without db. Without cache it is degraded,
+// or not ready, if cache is required
+func (controller *HealthController) Readiness(ctx context.Context) response.Response {
+	if !controller.isReady() {
+		return response.Response{
+			Status: http.StatusServiceUnavailable,
+			Body:   HealthResponseBody{Status: StatusNotReady},
+		}
+	}
+
+	db := controller.check(ctx, "db", controller.db)
+	cache := controller.check(ctx, "cache", controller.cache)
+	body := HealthResponseBody{
+		Status: StatusReady,
+		Checks: map[string]CheckResult{"db": db, "cache": cache},
+	}
+	status := http.StatusOK
+	switch {
+	case db.Status == StatusDown, cache.Status == StatusDown && controller.cacheRequired:
+		body.Status = StatusNotReady
+		status = http.StatusServiceUnavailable
+	case cache.Status == StatusDown:
+		body.Status = StatusDegraded
+	}
+
+	return response.Response{
+		Status: status,
+		Body:   body,
+	}
+}
+
+func (controller *HealthController) check(ctx context.Context, name string, pinger Pinger) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, controller.timeout)
+	defer cancel()
+	if err := pinger.Ping(ctx); err != nil {
+		controller.logger.Error(fmt.Errorf("readiness check %s: %w", name, err))
+		return CheckResult{Status: StatusDown}
+	}
+	return CheckResult{Status: StatusUp}
+}
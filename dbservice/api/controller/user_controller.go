@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"context"
+	"database-service/auth"
+	"database-service/dbservice/api/logger"
+	"database-service/dbservice/api/response"
+	"database-service/dbservice/api/services"
+	"database-service/domain"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type UserController struct {
+	logger      logger.Logger
+	authService auth.Service
+	userService services.Users
+}
+
+func NewUserController(authService auth.Service, userService services.Users, logger logger.Logger) *UserController {
+	return &UserController{authService: authService, userService: userService, logger: logger}
+}
+
+func (controller *UserController) AddRoutes(router gin.IRoutes) {
+	router.GET("/users", controller.ListUsersHandler)
+	router.POST("/users", controller.CreateUserHandler)
+	router.PUT("/users/:id/access-level", controller.UpdateAccessLevelHandler)
+	router.POST("/users/:id/deactivate", controller.DeactivateUserHandler)
+}
+
+type UsersResponse struct {
+	Users []UserResponse `json:"users"`
+	// NextCursor is an after_id for the next page, if there may be more users
+	NextCursor *int `json:"next_cursor,omitempty"`
+}
+
+type UserResponse struct {
+	Id            int        `json:"id"`
+	AccessLevel   string     `json:"access_level"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+}
+
+type UserRequest struct {
+	AccessLevel string `json:"access_level" binding:"required"`
+}
+
+func (controller *UserController) ListUsersHandler(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(MaxPageLimit)))
+	if err != nil || limit < 1 || limit > MaxPageLimit {
+		writeResponse(ctx, badRequest(fmt.Errorf("limit must be an integer between 1 and %d", MaxPageLimit)))
+		return
+	}
+	afterId, err := strconv.Atoi(ctx.DefaultQuery("after_id", "0"))
+	if err != nil || afterId < 0 {
+		writeResponse(ctx, badRequest(errors.New("after_id must be a non-negative integer")))
+		return
+	}
+	writeResponse(ctx, controller.ListUsers(ctx.Request.Context(), ctx.GetHeader("Authorization"), afterId, limit))
+}
+
+func (controller *UserController) CreateUserHandler(ctx *gin.Context) {
+	var request UserRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.CreateUser(ctx.Request.Context(), ctx.GetHeader("Authorization"), request))
+}
+
+func (controller *UserController) UpdateAccessLevelHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	var request UserRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		writeResponse(ctx, badRequest(err))
+		return
+	}
+	writeResponse(ctx, controller.UpdateAccessLevel(ctx.Request.Context(), ctx.GetHeader("Authorization"), id, request))
+}
+
+func (controller *UserController) DeactivateUserHandler(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		writeResponse(ctx, badRequest(errors.New("id must be an integer")))
+		return
+	}
+	writeResponse(ctx, controller.DeactivateUser(ctx.Request.Context(), ctx.GetHeader("Authorization"), id))
+}
+
+// ListUsers returns at most limit users with id greater than afterId
+func (controller *UserController) ListUsers(ctx context.Context, bearerToken string, afterId int, limit int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	users, err := controller.userService.ListUsers(ctx, claims, afterId, limit)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	body := UsersResponse{Users: make([]UserResponse, 0, len(users))}
+	for _, user := range users {
+		body.Users = append(body.Users, newUserResponse(user))
+	}
+	if len(users) == limit {
+		nextCursor := users[len(users)-1].Id
+		body.NextCursor = &nextCursor
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   body,
+	}
+}
+
+func (controller *UserController) CreateUser(ctx context.Context, bearerToken string, request UserRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	user, err := controller.userService.CreateUser(ctx, claims, request.AccessLevel)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusCreated,
+		Body:   newUserResponse(user),
+	}
+}
+
+func (controller *UserController) UpdateAccessLevel(ctx context.Context, bearerToken string, id int, request UserRequest) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	user, err := controller.userService.UpdateAccessLevel(ctx, claims, id, request.AccessLevel)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newUserResponse(user),
+	}
+}
+
+func (controller *UserController) DeactivateUser(ctx context.Context, bearerToken string, id int) response.Response {
+	claims, err := controller.authService.GetClaims(ctx, bearerToken)
+	if err != nil {
+		controller.logger.Error(err)
+		return unauthorized(err)
+	}
+
+	user, err := controller.userService.DeactivateUser(ctx, claims, id)
+	if err != nil {
+		return controller.errorResponse(err)
+	}
+
+	return response.Response{
+		Status: http.StatusOK,
+		Body:   newUserResponse(user),
+	}
+}
+
+// errorResponse maps errors of the services to response statuses
+func (controller *UserController) errorResponse(err error) response.Response {
+	if resp, ok := usersErrorResponse(controller.logger, err); ok {
+		return resp
+	}
+	switch {
+	case errors.Is(err, services.ErrForbidden):
+		return response.Response{Status: http.StatusForbidden, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, domain.ErrUserNotFound):
+		return response.Response{Status: http.StatusNotFound, Body: gin.H{"error": err.Error()}}
+	case errors.Is(err, domain.ErrInvalidAccessLevel):
+		return response.Response{Status: http.StatusBadRequest, Body: gin.H{"error": err.Error()}}
+	}
+	controller.logger.Error(err)
+	return response.Response{
+		Status: http.StatusInternalServerError,
+		Body:   nil,
+	}
+}
+
+func newUserResponse(user domain.User) UserResponse {
+	return UserResponse{
+		Id:            user.Id,
+		AccessLevel:   user.AccessLevel,
+		DeactivatedAt: user.DeactivatedAt,
+	}
+}
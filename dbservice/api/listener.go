@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"database-service/dbservice/api/logger"
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+// InvalidationChannel is a postgres channel, which is notified by triggers on data, users and roles tables
+const InvalidationChannel = "cache_invalidation"
+
+// Tables, which changes are notified to the InvalidationChannel
+const (
+	tableData            = "data"
+	tableUsers           = "users"
+	tableUserRoles       = "user_roles"
+	tableRolePermissions = "role_permissions"
+)
+
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+	listenerPingInterval = 90 * time.Second
+)
+
+type CacheInvalidator interface {
+	InvalidateUser(ctx context.Context, userId int) error
+	InvalidateRecords(ctx context.Context, ids ...int) error
+	PurgeAll(ctx context.Context) error
+}
+
+// UsersCacheInvalidator evicts cached roles and permissions of users
+type UsersCacheInvalidator interface {
+	InvalidateUser(ctx context.Context, userId int) error
+	InvalidateAllUsers(ctx context.Context) error
+}
+
+// Notification is a payload of the InvalidationChannel
+type Notification struct {
+	Table string `json:"table"`
+	Id    int    `json:"id"`
+	// Ids are changed records of the user. Changes of data are notified once per statement and user
+	Ids    []int `json:"ids"`
+	UserId int   `json:"user_id"`
+}
+
+// NotifyListener evicts cache entries, affected by changes in the database
+type NotifyListener struct {
+	listener         *pq.Listener
+	invalidator      CacheInvalidator
+	usersInvalidator UsersCacheInvalidator
+	logger           logger.Logger
+}
+
+// NewNotifyListener creates the listener. usersInvalidator may be nil, if users are not cached
+func NewNotifyListener(dsn string, invalidator CacheInvalidator, usersInvalidator UsersCacheInvalidator, logger logger.Logger) *NotifyListener {
+	listener := pq.NewListener(dsn, listenerMinReconnect, listenerMaxReconnect, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error(err)
+		}
+	})
+	return &NotifyListener{listener: listener, invalidator: invalidator, usersInvalidator: usersInvalidator, logger: logger}
+}
+
+// Run listens to the InvalidationChannel until ctx is done
+func (l *NotifyListener) Run(ctx context.Context) error {
+	if err := l.listener.Listen(InvalidationChannel); err != nil {
+		return err
+	}
+	defer l.listener.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-l.listener.Notify:
+			// nil notification is sent after reconnect, notifications sent in between are lost,
+			// so the whole cache is dropped
+			if n == nil {
+				l.logger.Info("cache invalidation listener reconnected")
+				l.purge(ctx)
+				continue
+			}
+			l.handle(ctx, n.Extra)
+		case <-time.After(listenerPingInterval):
+			go func() {
+				if err := l.listener.Ping(); err != nil {
+					l.logger.Error(err)
+				}
+			}()
+		}
+	}
+}
+
+// purge evicts all cache entries, which may be affected by lost notifications
+func (l *NotifyListener) purge(ctx context.Context) {
+	errs := []error{l.invalidator.PurgeAll(ctx)}
+	if l.usersInvalidator != nil {
+		errs = append(errs, l.usersInvalidator.InvalidateAllUsers(ctx))
+	}
+	for _, err := range errs {
+		if err != nil {
+			l.logger.Error(err)
+		}
+	}
+}
+
+func (l *NotifyListener) handle(ctx context.Context, payload string) {
+	var n Notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		l.logger.Error(err)
+		return
+	}
+	var errs []error
+	switch n.Table {
+	case tableData:
+		errs = append(errs, l.invalidator.InvalidateRecords(ctx, n.Ids...), l.invalidator.InvalidateUser(ctx, n.UserId))
+	case tableUsers:
+		errs = append(errs, l.invalidator.InvalidateUser(ctx, n.UserId))
+		if l.usersInvalidator != nil {
+			errs = append(errs, l.usersInvalidator.InvalidateUser(ctx, n.UserId))
+		}
+	case tableUserRoles:
+		if l.usersInvalidator != nil {
+			errs = append(errs, l.usersInvalidator.InvalidateUser(ctx, n.UserId))
+		}
+	case tableRolePermissions:
+		if l.usersInvalidator != nil {
+			errs = append(errs, l.usersInvalidator.InvalidateAllUsers(ctx))
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			l.logger.Error(err)
+		}
+	}
+}
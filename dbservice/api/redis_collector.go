@@ -0,0 +1,49 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisPoolStatsCollector exports redis connection pool stats
+type RedisPoolStatsCollector struct {
+	client *redis.Client
+
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+	staleConns *prometheus.Desc
+}
+
+func NewRedisPoolStatsCollector(client *redis.Client) *RedisPoolStatsCollector {
+	return &RedisPoolStatsCollector{
+		client:     client,
+		hits:       prometheus.NewDesc("database_service_redis_pool_hits_total", "Number of times free connection was found in the pool.", nil, nil),
+		misses:     prometheus.NewDesc("database_service_redis_pool_misses_total", "Number of times free connection was not found in the pool.", nil, nil),
+		timeouts:   prometheus.NewDesc("database_service_redis_pool_timeouts_total", "Number of times a wait timeout occurred.", nil, nil),
+		totalConns: prometheus.NewDesc("database_service_redis_pool_total_connections", "Number of total connections in the pool.", nil, nil),
+		idleConns:  prometheus.NewDesc("database_service_redis_pool_idle_connections", "Number of idle connections in the pool.", nil, nil),
+		staleConns: prometheus.NewDesc("database_service_redis_pool_stale_connections_total", "Number of stale connections removed from the pool.", nil, nil),
+	}
+}
+
+func (c *RedisPoolStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+func (c *RedisPoolStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns))
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database-service/auth"
+	"database-service/dbservice/api/logger"
+	"database-service/domain"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ApiKeyScheme is a scheme of the Authorization header with the api key, e.g. "ApiKey dbs_..."
+	ApiKeyScheme = "ApiKey"
+	apiKeyPrefix = "dbs_"
+	// apiKeyPrefixLength is a length of the key beginning stored to tell keys apart
+	apiKeyPrefixLength = 12
+	// ApiKeyTouchInterval limits updates of the last usage time of the key
+	ApiKeyTouchInterval = time.Minute
+)
+
+var ErrInvalidApiKey = errors.New("invalid api key")
+
+type ApiKeys interface {
+	// CreateApiKey creates the key for ownerId and returns it. The key can't be got later.
+	// Scopes of the key can't exceed scopes of the presented token.
+	// Only users with users:manage permission can create keys for other users
+	CreateApiKey(ctx context.Context, claims *auth.TokenClaims, ownerId int, name string, scopes []string, expiresAt *time.Time) (string, domain.ApiKey, error)
+	// RevokeApiKey revokes the key of the user. Users with users:manage permission can revoke any key
+	RevokeApiKey(ctx context.Context, claims *auth.TokenClaims, id int) error
+}
+
+// ApiKeyService manages api keys and authenticates requests with them, implementing auth.Service
+type ApiKeyService struct {
+	repo        domain.IApiKeyRepository
+	usersRepo   domain.IUserRepository
+	revocations auth.RevocationChecker
+	logger      logger.Logger
+}
+
+// NewApiKeyService creates the service. Keys are checked against revocations like tokens, so revocation
+// of all tokens of the user revokes keys created before it. revocations may be nil
+func NewApiKeyService(repo domain.IApiKeyRepository, usersRepo domain.IUserRepository, revocations auth.RevocationChecker,
+	logger logger.Logger) *ApiKeyService {
+	return &ApiKeyService{repo: repo, usersRepo: usersRepo, revocations: revocations, logger: logger}
+}
+
+func (service *ApiKeyService) CreateApiKey(ctx context.Context, claims *auth.TokenClaims, ownerId int, name string, scopes []string, expiresAt *time.Time) (string, domain.ApiKey, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return "", domain.ApiKey{}, err
+	}
+	if ownerId != claims.UserID && !permissions.Has(domain.PermissionUsersManage) {
+		return "", domain.ApiKey{}, ErrForbidden
+	}
+	scopes, err = narrowScopes(claims, scopes)
+	if err != nil {
+		return "", domain.ApiKey{}, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", domain.ApiKey{}, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	if scopes == nil {
+		scopes = []string{}
+	}
+	created, err := service.repo.CreateApiKey(ctx, hashApiKey(key), domain.ApiKey{
+		UserId:    ownerId,
+		Prefix:    key[:apiKeyPrefixLength],
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", domain.ApiKey{}, err
+	}
+	return key, created, nil
+}
+
+func (service *ApiKeyService) RevokeApiKey(ctx context.Context, claims *auth.TokenClaims, id int) error {
+	key, err := service.repo.GetApiKeyById(ctx, id)
+	if err != nil {
+		return err
+	}
+	if key.UserId != claims.UserID {
+		if err = requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+			return err
+		}
+	}
+	_, err = service.repo.RevokeApiKey(ctx, id)
+	return err
+}
+
+// GetClaims implements auth.Service for the ApiKeyScheme. Claims have the owner of the key and its scopes
+func (service *ApiKeyService) GetClaims(ctx context.Context, token string) (*auth.TokenClaims, error) {
+	split := strings.Split(token, " ")
+	if len(split) != 2 || split[0] != ApiKeyScheme {
+		return nil, auth.ErrInvalidTokenFormat
+	}
+
+	key, err := service.repo.GetApiKeyByHash(ctx, hashApiKey(split[1]))
+	if errors.Is(err, domain.ErrApiKeyNotFound) {
+		return nil, fmt.Errorf("%w: %w", auth.ErrInvalidToken, ErrInvalidApiKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", auth.ErrCredentialsUnavailable, err)
+	}
+	now := time.Now()
+	if key.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: %w", auth.ErrTokenRevoked, ErrInvalidApiKey)
+	}
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, fmt.Errorf("%w: %w", auth.ErrTokenExpired, ErrInvalidApiKey)
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= ApiKeyTouchInterval {
+		// the last usage time is informational, so the key works even if it is not updated
+		if err = service.repo.TouchApiKey(ctx, key.Id); err != nil {
+			service.logger.Error(fmt.Errorf("touch api key %d: %w", key.Id, err))
+		}
+	}
+
+	claims := &auth.TokenClaims{
+		UserID:  key.UserId,
+		Scopes:  key.Scopes,
+		Derived: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       "api_key_" + strconv.Itoa(key.Id),
+			IssuedAt: jwt.NewNumericDate(key.CreatedAt),
+		},
+	}
+	if key.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*key.ExpiresAt)
+	}
+	if service.revocations != nil {
+		revoked, err := service.revocations.IsRevoked(ctx, claims)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", auth.ErrRevocationUnavailable, err)
+		}
+		if revoked {
+			return nil, fmt.Errorf("%w: %w", auth.ErrTokenRevoked, ErrInvalidApiKey)
+		}
+	}
+	return claims, nil
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+type FakeApiKeyService struct {
+	CreateApiKeyStub func(ctx context.Context, claims *auth.TokenClaims, ownerId int, name string, scopes []string, expiresAt *time.Time) (string, domain.ApiKey, error)
+	RevokeApiKeyStub func(ctx context.Context, claims *auth.TokenClaims, id int) error
+	Service          ApiKeys
+}
+
+func (service FakeApiKeyService) CreateApiKey(ctx context.Context, claims *auth.TokenClaims, ownerId int, name string, scopes []string, expiresAt *time.Time) (string, domain.ApiKey, error) {
+	if service.CreateApiKeyStub != nil {
+		return service.CreateApiKeyStub(ctx, claims, ownerId, name, scopes, expiresAt)
+	}
+	if service.Service != nil {
+		return service.Service.CreateApiKey(ctx, claims, ownerId, name, scopes, expiresAt)
+	}
+	panic("CreateApiKey: no function or service provided")
+}
+
+func (service FakeApiKeyService) RevokeApiKey(ctx context.Context, claims *auth.TokenClaims, id int) error {
+	if service.RevokeApiKeyStub != nil {
+		return service.RevokeApiKeyStub(ctx, claims, id)
+	}
+	if service.Service != nil {
+		return service.Service.RevokeApiKey(ctx, claims, id)
+	}
+	panic("RevokeApiKey: no function or service provided")
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"database-service/auth"
+	"database-service/domain"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	// ErrUnknownUser is returned when the user of the token does not exist, e.g. it was deleted
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrUsersUnavailable is returned when permissions of the user can't be resolved, e.g. the db is down
+	ErrUsersUnavailable = errors.New("users are unavailable")
+)
+
+// resolvePermissions returns permissions of the user of the token, limited by its scopes.
+// Errors of the repository are wrapped into ErrUnknownUser or ErrUsersUnavailable, except of the canceled request
+func resolvePermissions(ctx context.Context, usersRepo domain.IUserRepository, claims *auth.TokenClaims) (domain.Permissions, error) {
+	permissions, err := usersRepo.GetPermissions(ctx, claims.UserID)
+	switch {
+	case errors.Is(err, domain.ErrUserNotFound):
+		return nil, fmt.Errorf("%w: %w", ErrUnknownUser, err)
+	case errors.Is(err, context.Canceled):
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("%w: %w", ErrUsersUnavailable, err)
+	}
+	return permissions.Intersect(claims.Scopes), nil
+}
+
+// requirePermission returns ErrForbidden, if the user of the token has no permission
+func requirePermission(ctx context.Context, usersRepo domain.IUserRepository, claims *auth.TokenClaims, permission string) error {
+	permissions, err := resolvePermissions(ctx, usersRepo, claims)
+	if err != nil {
+		return err
+	}
+	if !permissions.Has(permission) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// narrowScopes returns scopes of a credential derived from the token, e.g. an api key. They can't exceed scopes of the token:
+// if the token is scoped, requested scopes must be a subset of them, and empty requested scopes inherit them
+func narrowScopes(claims *auth.TokenClaims, requested []string) ([]string, error) {
+	if len(claims.Scopes) == 0 {
+		return requested, nil
+	}
+	if len(requested) == 0 {
+		return claims.Scopes, nil
+	}
+	for _, scope := range requested {
+		if !slices.Contains(claims.Scopes, scope) {
+			return nil, ErrForbidden
+		}
+	}
+	return requested, nil
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"database-service/auth"
+	"database-service/domain"
+	"encoding/binary"
+	"fmt"
+	cachepkg "github.com/go-redis/cache/v9"
+	"time"
+)
+
+const revocationLocalCacheSize = 10000
+
+type Revocation interface {
+	// RevokeToken revokes the token by jti until expiresAt. If expiresAt is zero, the default ttl is used.
+	// Only users with users:manage permission can revoke tokens
+	RevokeToken(ctx context.Context, claims *auth.TokenClaims, jti string, expiresAt time.Time) error
+	// RevokeUserTokens revokes all tokens of targetUserId issued before now. Only users with users:manage permission can revoke tokens
+	RevokeUserTokens(ctx context.Context, claims *auth.TokenClaims, targetUserId int) error
+}
+
+// RevocationService manages the revocation list and checks tokens against it.
+// Results of checks are cached in memory for a short time, so a revocation made by another instance
+// takes effect on this one within that time
+type RevocationService struct {
+	repo       domain.IRevocationRepository
+	usersRepo  domain.IUserRepository
+	local      *cachepkg.TinyLFU
+	defaultTTL time.Duration
+}
+
+// NewRevocationService creates the service. Local cache is disabled, if cacheTTL is zero
+func NewRevocationService(repo domain.IRevocationRepository, usersRepo domain.IUserRepository, cacheTTL time.Duration, defaultTTL time.Duration) *RevocationService {
+	service := &RevocationService{repo: repo, usersRepo: usersRepo, defaultTTL: defaultTTL}
+	if cacheTTL > 0 {
+		service.local = cachepkg.NewTinyLFU(revocationLocalCacheSize, cacheTTL)
+	}
+	return service
+}
+
+func (service *RevocationService) RevokeToken(ctx context.Context, claims *auth.TokenClaims, jti string, expiresAt time.Time) error {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return err
+	}
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(service.defaultTTL)
+	}
+	if err := service.repo.RevokeToken(ctx, jti, expiresAt); err != nil {
+		return err
+	}
+	service.setLocal(tokenLocalKey(jti), []byte{1})
+	return nil
+}
+
+func (service *RevocationService) RevokeUserTokens(ctx context.Context, claims *auth.TokenClaims, targetUserId int) error {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return err
+	}
+	return service.RecordUserRevocation(ctx, targetUserId, userRevocationTime())
+}
+
+// RecordUserRevocation stores the revocation of all tokens of the user issued not after before
+// and puts it to the local cache. It implements UserRevocationRecorder
+func (service *RevocationService) RecordUserRevocation(ctx context.Context, userId int, before time.Time) error {
+	if err := service.repo.RevokeUserTokens(ctx, userId, before); err != nil {
+		return err
+	}
+	service.setLocal(userLocalKey(userId), binary.BigEndian.AppendUint64(nil, uint64(before.UnixNano())))
+	return nil
+}
+
+// userRevocationTime returns the time to revoke tokens issued before. iat of tokens has a second resolution,
+// so tokens issued within the current second are revoked as well
+func userRevocationTime() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// IsRevoked implements auth.RevocationChecker. Tokens issued not after the revocation of all user tokens
+// and tokens without iat are revoked by it
+func (service *RevocationService) IsRevoked(ctx context.Context, claims *auth.TokenClaims) (bool, error) {
+	if claims.ID != "" {
+		revoked, err := service.isTokenRevoked(ctx, claims.ID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	before, err := service.getUserRevokedBefore(ctx, claims.UserID)
+	if err != nil || before.IsZero() {
+		return false, err
+	}
+	return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(before.Truncate(time.Second)), nil
+}
+
+func (service *RevocationService) isTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	key := tokenLocalKey(jti)
+	if value, ok := service.getLocal(key); ok {
+		return len(value) == 1 && value[0] == 1, nil
+	}
+	revoked, err := service.repo.IsTokenRevoked(ctx, jti)
+	if err != nil {
+		return false, err
+	}
+	value := []byte{0}
+	if revoked {
+		value[0] = 1
+	}
+	service.setLocal(key, value)
+	return revoked, nil
+}
+
+func (service *RevocationService) getUserRevokedBefore(ctx context.Context, userId int) (time.Time, error) {
+	key := userLocalKey(userId)
+	if value, ok := service.getLocal(key); ok && len(value) == 8 {
+		nanos := int64(binary.BigEndian.Uint64(value))
+		if nanos == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(0, nanos), nil
+	}
+	before, err := service.repo.GetUserRevokedBefore(ctx, userId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nanos int64
+	if !before.IsZero() {
+		nanos = before.UnixNano()
+	}
+	service.setLocal(key, binary.BigEndian.AppendUint64(nil, uint64(nanos)))
+	return before, nil
+}
+
+func (service *RevocationService) getLocal(key string) ([]byte, bool) {
+	if service.local == nil {
+		return nil, false
+	}
+	return service.local.Get(key)
+}
+
+func (service *RevocationService) setLocal(key string, value []byte) {
+	if service.local != nil {
+		service.local.Set(key, value)
+	}
+}
+
+func tokenLocalKey(jti string) string {
+	return "token_" + jti
+}
+
+func userLocalKey(userId int) string {
+	return fmt.Sprintf("user_%d", userId)
+}
+
+type FakeRevocationService struct {
+	RevokeTokenStub      func(ctx context.Context, claims *auth.TokenClaims, jti string, expiresAt time.Time) error
+	RevokeUserTokensStub func(ctx context.Context, claims *auth.TokenClaims, targetUserId int) error
+	Service              Revocation
+}
+
+func (service FakeRevocationService) RevokeToken(ctx context.Context, claims *auth.TokenClaims, jti string, expiresAt time.Time) error {
+	if service.RevokeTokenStub != nil {
+		return service.RevokeTokenStub(ctx, claims, jti, expiresAt)
+	}
+	if service.Service != nil {
+		return service.Service.RevokeToken(ctx, claims, jti, expiresAt)
+	}
+	panic("RevokeToken: no function or service provided")
+}
+
+func (service FakeRevocationService) RevokeUserTokens(ctx context.Context, claims *auth.TokenClaims, targetUserId int) error {
+	if service.RevokeUserTokensStub != nil {
+		return service.RevokeUserTokensStub(ctx, claims, targetUserId)
+	}
+	if service.Service != nil {
+		return service.Service.RevokeUserTokens(ctx, claims, targetUserId)
+	}
+	panic("RevokeUserTokens: no function or service provided")
+}
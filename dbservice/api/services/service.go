@@ -1,13 +1,28 @@
 package services
 
 import (
+	"context"
+	"database-service/auth"
 	"database-service/domain"
+	"errors"
 )
 
+// ErrForbidden is returned when the user has no access to the requested operation
+var ErrForbidden = errors.New("forbidden")
+
 type Data interface {
-	GetDataByAccessLevel(userId int) ([]domain.Data, error)
+	// GetDataByAccessLevel returns all records with data:read:all permission, or records of the user with data:read:own
+	GetDataByAccessLevel(ctx context.Context, claims *auth.TokenClaims) ([]domain.Data, error)
+	GetDataPageByAccessLevel(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.Data, error)
+	// GetDataById returns the record if it belongs to the user with data:read:own permission or the user has data:read:all
+	GetDataById(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error)
+	// CreateData creates the record for ownerId. Only users with data:write:all can create records for other users
+	CreateData(ctx context.Context, claims *auth.TokenClaims, ownerId int, data string) (domain.Data, error)
+	UpdateData(ctx context.Context, claims *auth.TokenClaims, id int, data string) (domain.Data, error)
+	DeleteData(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error)
 }
 
+// DataService authorizes access to data by permissions of the user, resolved for each request
 type DataService struct {
 	dataRepo  domain.IDataRepository
 	usersRepo domain.IUserRepository
@@ -20,25 +35,157 @@ func NewDataService(dataRepo domain.IDataRepository, usersRepo domain.IUserRepos
 	}
 }
 
-func (service *DataService) GetDataByAccessLevel(userId int) ([]domain.Data, error) {
-	isAdmin := service.usersRepo.IsAdmin(userId)
-	if isAdmin {
-		return service.dataRepo.GetDataByAdmin()
+func (service *DataService) GetDataByAccessLevel(ctx context.Context, claims *auth.TokenClaims) ([]domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case permissions.Has(domain.PermissionDataReadAll):
+		return service.dataRepo.GetDataByAdmin(ctx)
+	case permissions.Has(domain.PermissionDataReadOwn):
+		return service.dataRepo.GetDataByUser(ctx, claims.UserID)
 	}
-	return service.dataRepo.GetDataByUser(userId)
+	return nil, ErrForbidden
+}
+
+func (service *DataService) GetDataPageByAccessLevel(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case permissions.Has(domain.PermissionDataReadAll):
+		return service.dataRepo.GetDataPageByAdmin(ctx, afterId, limit)
+	case permissions.Has(domain.PermissionDataReadOwn):
+		return service.dataRepo.GetDataPageByUser(ctx, claims.UserID, afterId, limit)
+	}
+	return nil, ErrForbidden
+}
+
+func (service *DataService) GetDataById(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	if !permissions.Has(domain.PermissionDataReadAll) && !permissions.Has(domain.PermissionDataReadOwn) {
+		return nil, ErrForbidden
+	}
+	data, err := service.dataRepo.GetDataById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if data.GetUserId() != claims.UserID && !permissions.Has(domain.PermissionDataReadAll) {
+		return nil, ErrForbidden
+	}
+	return data, nil
+}
+
+func (service *DataService) CreateData(ctx context.Context, claims *auth.TokenClaims, ownerId int, data string) (domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	if !permissions.Has(domain.PermissionDataWriteAll) && (ownerId != claims.UserID || !permissions.Has(domain.PermissionDataWriteOwn)) {
+		return nil, ErrForbidden
+	}
+	return service.dataRepo.CreateData(ctx, ownerId, data)
+}
+
+func (service *DataService) UpdateData(ctx context.Context, claims *auth.TokenClaims, id int, data string) (domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case permissions.Has(domain.PermissionDataWriteAll):
+		return service.dataRepo.UpdateDataByAdmin(ctx, id, data)
+	case permissions.Has(domain.PermissionDataWriteOwn):
+		return service.dataRepo.UpdateDataByUser(ctx, claims.UserID, id, data)
+	}
+	return nil, ErrForbidden
+}
+
+func (service *DataService) DeleteData(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error) {
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case permissions.Has(domain.PermissionDataWriteAll):
+		return service.dataRepo.DeleteDataByAdmin(ctx, id)
+	case permissions.Has(domain.PermissionDataWriteOwn):
+		return service.dataRepo.DeleteDataByUser(ctx, claims.UserID, id)
+	}
+	return nil, ErrForbidden
 }
 
 type FakeDataService struct {
-	GetDataByAccessLevelStub func(userId int) ([]domain.Data, error)
-	Service                  Data
+	GetDataByAccessLevelStub     func(ctx context.Context, claims *auth.TokenClaims) ([]domain.Data, error)
+	GetDataPageByAccessLevelStub func(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.Data, error)
+	GetDataByIdStub              func(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error)
+	CreateDataStub               func(ctx context.Context, claims *auth.TokenClaims, ownerId int, data string) (domain.Data, error)
+	UpdateDataStub               func(ctx context.Context, claims *auth.TokenClaims, id int, data string) (domain.Data, error)
+	DeleteDataStub               func(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error)
+	Service                      Data
 }
 
-func (service FakeDataService) GetDataByAccessLevel(userId int) ([]domain.Data, error) {
+func (service FakeDataService) GetDataByAccessLevel(ctx context.Context, claims *auth.TokenClaims) ([]domain.Data, error) {
 	if service.GetDataByAccessLevelStub != nil {
-		return service.GetDataByAccessLevelStub(userId)
+		return service.GetDataByAccessLevelStub(ctx, claims)
 	}
 	if service.Service != nil {
-		return service.Service.GetDataByAccessLevel(userId)
+		return service.Service.GetDataByAccessLevel(ctx, claims)
 	}
 	panic("GetDataByAccessLevel: no function or service provided")
 }
+
+func (service FakeDataService) GetDataPageByAccessLevel(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.Data, error) {
+	if service.GetDataPageByAccessLevelStub != nil {
+		return service.GetDataPageByAccessLevelStub(ctx, claims, afterId, limit)
+	}
+	if service.Service != nil {
+		return service.Service.GetDataPageByAccessLevel(ctx, claims, afterId, limit)
+	}
+	panic("GetDataPageByAccessLevel: no function or service provided")
+}
+
+func (service FakeDataService) GetDataById(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error) {
+	if service.GetDataByIdStub != nil {
+		return service.GetDataByIdStub(ctx, claims, id)
+	}
+	if service.Service != nil {
+		return service.Service.GetDataById(ctx, claims, id)
+	}
+	panic("GetDataById: no function or service provided")
+}
+
+func (service FakeDataService) CreateData(ctx context.Context, claims *auth.TokenClaims, ownerId int, data string) (domain.Data, error) {
+	if service.CreateDataStub != nil {
+		return service.CreateDataStub(ctx, claims, ownerId, data)
+	}
+	if service.Service != nil {
+		return service.Service.CreateData(ctx, claims, ownerId, data)
+	}
+	panic("CreateData: no function or service provided")
+}
+
+func (service FakeDataService) UpdateData(ctx context.Context, claims *auth.TokenClaims, id int, data string) (domain.Data, error) {
+	if service.UpdateDataStub != nil {
+		return service.UpdateDataStub(ctx, claims, id, data)
+	}
+	if service.Service != nil {
+		return service.Service.UpdateData(ctx, claims, id, data)
+	}
+	panic("UpdateData: no function or service provided")
+}
+
+func (service FakeDataService) DeleteData(ctx context.Context, claims *auth.TokenClaims, id int) (domain.Data, error) {
+	if service.DeleteDataStub != nil {
+		return service.DeleteDataStub(ctx, claims, id)
+	}
+	if service.Service != nil {
+		return service.Service.DeleteData(ctx, claims, id)
+	}
+	panic("DeleteData: no function or service provided")
+}
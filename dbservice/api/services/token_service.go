@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database-service/auth"
+	"database-service/domain"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned when the refresh token does not exist, is expired or revoked
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when the used refresh token is presented again.
+	// The whole token family is revoked in this case, since the token may be stolen
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+	// ErrDerivedCredentials is returned when tokens are requested by credentials issued by the service itself,
+	// e.g. by an access token of a refresh token or by an API key, so they can't be prolonged by refresh tokens
+	ErrDerivedCredentials = errors.New("tokens can be issued only by a token of the provider")
+)
+
+// TokenIssuer generates access tokens, it is implemented by auth.JwtService
+type TokenIssuer interface {
+	IssueDerivedToken(userId int, scopes []string) (string, *auth.TokenClaims, error)
+}
+
+type TokenPair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+type Tokens interface {
+	// IssueTokens issues tokens for subjectId with scopes of the presented token, which must be a token of the provider.
+	// Only users with users:manage permission can issue tokens for other users
+	IssueTokens(ctx context.Context, claims *auth.TokenClaims, subjectId int) (TokenPair, error)
+	// RevokeIssuedBy revokes refresh tokens issued by the provider token with sourceJti and access tokens issued with them.
+	// The permission to revoke the token is checked by the caller
+	RevokeIssuedBy(ctx context.Context, sourceJti string) error
+	// RefreshTokens exchanges the refresh token for the new pair. Each refresh token can be used only once,
+	// tokens of deactivated users and tokens created before the revocation of all user tokens are invalid
+	RefreshTokens(ctx context.Context, refreshToken string) (TokenPair, error)
+}
+
+type TokenService struct {
+	issuer         TokenIssuer
+	refreshRepo    domain.IRefreshTokenRepository
+	revocationRepo domain.IRevocationRepository
+	usersRepo      domain.IUserRepository
+	refreshTTL     time.Duration
+}
+
+func NewTokenService(issuer TokenIssuer, refreshRepo domain.IRefreshTokenRepository, revocationRepo domain.IRevocationRepository,
+	usersRepo domain.IUserRepository, refreshTTL time.Duration) *TokenService {
+	return &TokenService{
+		issuer:         issuer,
+		refreshRepo:    refreshRepo,
+		revocationRepo: revocationRepo,
+		usersRepo:      usersRepo,
+		refreshTTL:     refreshTTL,
+	}
+}
+
+func (service *TokenService) IssueTokens(ctx context.Context, claims *auth.TokenClaims, subjectId int) (TokenPair, error) {
+	// permissions are resolved even for the own tokens, so deactivated users can't issue them
+	permissions, err := resolvePermissions(ctx, service.usersRepo, claims)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if claims.Derived {
+		return TokenPair{}, ErrDerivedCredentials
+	}
+	if subjectId != claims.UserID && !permissions.Has(domain.PermissionUsersManage) {
+		return TokenPair{}, ErrForbidden
+	}
+	pair, hash, token, err := service.newPair(subjectId, claims.Scopes, uuid.New().String(), claims.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if err = service.refreshRepo.CreateRefreshToken(ctx, hash, token); err != nil {
+		return TokenPair{}, err
+	}
+	return pair, nil
+}
+
+func (service *TokenService) RefreshTokens(ctx context.Context, refreshToken string) (TokenPair, error) {
+	var pair TokenPair
+	// the used token is marked as used only along with storing the new one
+	token, err := service.refreshRepo.RotateRefreshToken(ctx, hashRefreshToken(refreshToken),
+		func(token domain.RefreshToken) (string, domain.RefreshToken, error) {
+			if err := service.checkRefreshToken(ctx, token); err != nil {
+				return "", domain.RefreshToken{}, err
+			}
+			next, hash, nextToken, err := service.newPair(token.UserId, token.Scopes, token.FamilyId, token.SourceJti)
+			pair = next
+			return hash, nextToken, err
+		})
+	switch {
+	case errors.Is(err, domain.ErrRefreshTokenNotFound):
+		return TokenPair{}, ErrInvalidRefreshToken
+	case errors.Is(err, domain.ErrRefreshTokenUsed):
+		if token.RevokedAt != nil {
+			return TokenPair{}, ErrInvalidRefreshToken
+		}
+		if err = service.revokeFamily(ctx, token.FamilyId); err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrRefreshTokenReused
+	case err != nil:
+		return TokenPair{}, err
+	}
+	return pair, nil
+}
+
+func (service *TokenService) RevokeIssuedBy(ctx context.Context, sourceJti string) error {
+	if sourceJti == "" {
+		return nil
+	}
+	tokens, err := service.refreshRepo.RevokeRefreshTokensBySource(ctx, sourceJti)
+	if err != nil {
+		return err
+	}
+	return service.revokeAccessTokens(ctx, tokens)
+}
+
+// checkRefreshToken rejects expired tokens, tokens of deactivated users, tokens revoked along with all user tokens
+// and tokens issued by a revoked token
+func (service *TokenService) checkRefreshToken(ctx context.Context, token domain.RefreshToken) error {
+	if time.Now().After(token.ExpiresAt) {
+		return ErrInvalidRefreshToken
+	}
+	if _, err := service.usersRepo.GetAccessLevel(ctx, token.UserId); errors.Is(err, domain.ErrUserNotFound) {
+		return ErrInvalidRefreshToken
+	} else if err != nil {
+		return err
+	}
+	before, err := service.revocationRepo.GetUserRevokedBefore(ctx, token.UserId)
+	if err != nil {
+		return fmt.Errorf("%w: %w", auth.ErrRevocationUnavailable, err)
+	}
+	// compared with the resolution of iat, like access tokens are
+	if !before.IsZero() && !token.CreatedAt.Truncate(time.Second).After(before) {
+		return ErrInvalidRefreshToken
+	}
+	if token.SourceJti == "" {
+		return nil
+	}
+	// the family is revoked along with the source token, this covers revocations, which failed to revoke it
+	revoked, err := service.revocationRepo.IsTokenRevoked(ctx, token.SourceJti)
+	if err != nil {
+		return fmt.Errorf("%w: %w", auth.ErrRevocationUnavailable, err)
+	}
+	if revoked {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// newPair issues the access token and the refresh token, which is returned along with its hash to be stored
+func (service *TokenService) newPair(userId int, scopes []string, familyId string, sourceJti string) (TokenPair, string, domain.RefreshToken, error) {
+	accessToken, claims, err := service.issuer.IssueDerivedToken(userId, scopes)
+	if err != nil {
+		return TokenPair{}, "", domain.RefreshToken{}, err
+	}
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, "", domain.RefreshToken{}, err
+	}
+	pair := TokenPair{
+		AccessToken:      accessToken,
+		AccessExpiresAt:  claims.ExpiresAt.Time,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: time.Now().Add(service.refreshTTL),
+	}
+	return pair, hashRefreshToken(refreshToken), domain.RefreshToken{
+		FamilyId:        familyId,
+		UserId:          userId,
+		Scopes:          scopes,
+		SourceJti:       sourceJti,
+		AccessJti:       claims.ID,
+		AccessExpiresAt: pair.AccessExpiresAt,
+		ExpiresAt:       pair.RefreshExpiresAt,
+	}, nil
+}
+
+// revokeFamily revokes refresh tokens of the family and access tokens issued along with them
+func (service *TokenService) revokeFamily(ctx context.Context, familyId string) error {
+	tokens, err := service.refreshRepo.RevokeRefreshTokenFamily(ctx, familyId)
+	if err != nil {
+		return err
+	}
+	return service.revokeAccessTokens(ctx, tokens)
+}
+
+// revokeAccessTokens revokes access tokens issued along with the refresh tokens, which are not expired yet
+func (service *TokenService) revokeAccessTokens(ctx context.Context, tokens []domain.RefreshToken) error {
+	var errs []error
+	for _, token := range tokens {
+		if token.AccessExpiresAt.Before(time.Now()) {
+			continue
+		}
+		if err := service.revocationRepo.RevokeToken(ctx, token.AccessJti, token.AccessExpiresAt); err != nil {
+			errs = append(errs, fmt.Errorf("revoke access token of the family %s: %w", token.FamilyId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+type FakeTokenService struct {
+	IssueTokensStub    func(ctx context.Context, claims *auth.TokenClaims, subjectId int) (TokenPair, error)
+	RefreshTokensStub  func(ctx context.Context, refreshToken string) (TokenPair, error)
+	RevokeIssuedByStub func(ctx context.Context, sourceJti string) error
+	Service            Tokens
+}
+
+func (service FakeTokenService) IssueTokens(ctx context.Context, claims *auth.TokenClaims, subjectId int) (TokenPair, error) {
+	if service.IssueTokensStub != nil {
+		return service.IssueTokensStub(ctx, claims, subjectId)
+	}
+	if service.Service != nil {
+		return service.Service.IssueTokens(ctx, claims, subjectId)
+	}
+	panic("IssueTokens: no function or service provided")
+}
+
+func (service FakeTokenService) RefreshTokens(ctx context.Context, refreshToken string) (TokenPair, error) {
+	if service.RefreshTokensStub != nil {
+		return service.RefreshTokensStub(ctx, refreshToken)
+	}
+	if service.Service != nil {
+		return service.Service.RefreshTokens(ctx, refreshToken)
+	}
+	panic("RefreshTokens: no function or service provided")
+}
+
+func (service FakeTokenService) RevokeIssuedBy(ctx context.Context, sourceJti string) error {
+	if service.RevokeIssuedByStub != nil {
+		return service.RevokeIssuedByStub(ctx, sourceJti)
+	}
+	if service.Service != nil {
+		return service.Service.RevokeIssuedBy(ctx, sourceJti)
+	}
+	panic("RevokeIssuedBy: no function or service provided")
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"database-service/auth"
+	"database-service/dbservice/api/logger"
+	"database-service/domain"
+	"fmt"
+	"time"
+)
+
+// UserCachePurger deletes all cached entries of the user, it is implemented by domain.CachedDataRepository
+type UserCachePurger interface {
+	PurgeUser(ctx context.Context, userId int) error
+}
+
+// UserCacheInvalidator evicts cached permissions of the user, it is implemented by domain.CachedUserRepository
+type UserCacheInvalidator interface {
+	InvalidateUser(ctx context.Context, userId int) error
+}
+
+// UserRevocationRecorder spreads the revocation of user tokens committed to the db to other stores and caches,
+// it is implemented by RevocationService
+type UserRevocationRecorder interface {
+	RecordUserRevocation(ctx context.Context, userId int, before time.Time) error
+}
+
+// Users manages users. All methods require users:manage permission
+type Users interface {
+	// ListUsers returns at most limit users with id greater than afterId, including deactivated ones
+	ListUsers(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.User, error)
+	CreateUser(ctx context.Context, claims *auth.TokenClaims, accessLevel string) (domain.User, error)
+	UpdateAccessLevel(ctx context.Context, claims *auth.TokenClaims, userId int, accessLevel string) (domain.User, error)
+	// DeactivateUser makes tokens and api keys of the user stop working and purges its cache.
+	// Tokens are revoked along with the deactivation, caches are purged on a best-effort basis.
+	// Users can't deactivate themselves, so the last admin is not locked out
+	DeactivateUser(ctx context.Context, claims *auth.TokenClaims, userId int) (domain.User, error)
+}
+
+type UserService struct {
+	repo        domain.IUserManagementRepository
+	usersRepo   domain.IUserRepository
+	revocations UserRevocationRecorder
+	dataCache   UserCachePurger
+	usersCache  UserCacheInvalidator
+	logger      logger.Logger
+}
+
+// NewUserService creates the service. usersCache may be nil, if permissions of users are not cached
+func NewUserService(repo domain.IUserManagementRepository, usersRepo domain.IUserRepository, revocations UserRevocationRecorder,
+	dataCache UserCachePurger, usersCache UserCacheInvalidator, logger logger.Logger) *UserService {
+	return &UserService{
+		repo:        repo,
+		usersRepo:   usersRepo,
+		revocations: revocations,
+		dataCache:   dataCache,
+		usersCache:  usersCache,
+		logger:      logger,
+	}
+}
+
+func (service *UserService) ListUsers(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.User, error) {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return nil, err
+	}
+	return service.repo.ListUsers(ctx, afterId, limit)
+}
+
+func (service *UserService) CreateUser(ctx context.Context, claims *auth.TokenClaims, accessLevel string) (domain.User, error) {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return domain.User{}, err
+	}
+	return service.repo.CreateUser(ctx, accessLevel)
+}
+
+func (service *UserService) UpdateAccessLevel(ctx context.Context, claims *auth.TokenClaims, userId int, accessLevel string) (domain.User, error) {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return domain.User{}, err
+	}
+	user, err := service.repo.UpdateAccessLevel(ctx, userId, accessLevel)
+	if err != nil {
+		return domain.User{}, err
+	}
+	// the change is committed, and other instances are notified by the trigger on users table,
+	// so the local invalidation only speeds up its effect
+	if err = service.invalidateUser(ctx, userId); err != nil {
+		service.logger.Error(fmt.Errorf("invalidate permissions of user %d: %w", userId, err))
+	}
+	return user, nil
+}
+
+func (service *UserService) DeactivateUser(ctx context.Context, claims *auth.TokenClaims, userId int) (domain.User, error) {
+	if err := requirePermission(ctx, service.usersRepo, claims, domain.PermissionUsersManage); err != nil {
+		return domain.User{}, err
+	}
+	if userId == claims.UserID {
+		return domain.User{}, ErrForbidden
+	}
+	before := userRevocationTime()
+	user, err := service.repo.DeactivateUser(ctx, userId, before)
+	if err != nil {
+		return domain.User{}, err
+	}
+	// the deactivation and the revocation are committed, so the rest only speeds up their effect.
+	// Deactivated users are not found by usersRepo, so their api keys stop working along with revoked tokens
+	if err = service.revocations.RecordUserRevocation(ctx, userId, before); err != nil {
+		service.logger.Error(fmt.Errorf("record revocation of deactivated user %d: %w", userId, err))
+	}
+	if err = service.invalidateUser(ctx, userId); err != nil {
+		service.logger.Error(fmt.Errorf("invalidate permissions of deactivated user %d: %w", userId, err))
+	}
+	if err = service.dataCache.PurgeUser(ctx, userId); err != nil {
+		service.logger.Error(fmt.Errorf("purge cache of deactivated user %d: %w", userId, err))
+	}
+	return user, nil
+}
+
+func (service *UserService) invalidateUser(ctx context.Context, userId int) error {
+	if service.usersCache == nil {
+		return nil
+	}
+	return service.usersCache.InvalidateUser(ctx, userId)
+}
+
+type FakeUserService struct {
+	ListUsersStub         func(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.User, error)
+	CreateUserStub        func(ctx context.Context, claims *auth.TokenClaims, accessLevel string) (domain.User, error)
+	UpdateAccessLevelStub func(ctx context.Context, claims *auth.TokenClaims, userId int, accessLevel string) (domain.User, error)
+	DeactivateUserStub    func(ctx context.Context, claims *auth.TokenClaims, userId int) (domain.User, error)
+	Service               Users
+}
+
+func (service FakeUserService) ListUsers(ctx context.Context, claims *auth.TokenClaims, afterId int, limit int) ([]domain.User, error) {
+	if service.ListUsersStub != nil {
+		return service.ListUsersStub(ctx, claims, afterId, limit)
+	}
+	if service.Service != nil {
+		return service.Service.ListUsers(ctx, claims, afterId, limit)
+	}
+	panic("ListUsers: no function or service provided")
+}
+
+func (service FakeUserService) CreateUser(ctx context.Context, claims *auth.TokenClaims, accessLevel string) (domain.User, error) {
+	if service.CreateUserStub != nil {
+		return service.CreateUserStub(ctx, claims, accessLevel)
+	}
+	if service.Service != nil {
+		return service.Service.CreateUser(ctx, claims, accessLevel)
+	}
+	panic("CreateUser: no function or service provided")
+}
+
+func (service FakeUserService) UpdateAccessLevel(ctx context.Context, claims *auth.TokenClaims, userId int, accessLevel string) (domain.User, error) {
+	if service.UpdateAccessLevelStub != nil {
+		return service.UpdateAccessLevelStub(ctx, claims, userId, accessLevel)
+	}
+	if service.Service != nil {
+		return service.Service.UpdateAccessLevel(ctx, claims, userId, accessLevel)
+	}
+	panic("UpdateAccessLevel: no function or service provided")
+}
+
+func (service FakeUserService) DeactivateUser(ctx context.Context, claims *auth.TokenClaims, userId int) (domain.User, error) {
+	if service.DeactivateUserStub != nil {
+		return service.DeactivateUserStub(ctx, claims, userId)
+	}
+	if service.Service != nil {
+		return service.Service.DeactivateUser(ctx, claims, userId)
+	}
+	panic("DeactivateUser: no function or service provided")
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"database-service/dbservice/api"
+	"log"
 )
 
 func main() {
 	dbServiceApi, err := api.NewApi()
 	if err != nil {
-		return
+		log.Fatal(err)
+	}
+	if err = dbServiceApi.Run(); err != nil {
+		log.Fatal(err)
 	}
-	dbServiceApi.Run()
 }
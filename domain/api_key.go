@@ -0,0 +1,152 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	sqlApiKeyColumns = "id, user_id, prefix, name, scopes, expires_at, last_used_at, revoked_at, created_at"
+	sqlCreateApiKey  = `INSERT INTO api_keys (user_id, key_hash, prefix, name, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + sqlApiKeyColumns
+	sqlQueryApiKeyByHash = "SELECT " + sqlApiKeyColumns + " FROM api_keys WHERE key_hash = $1"
+	sqlQueryApiKeyById   = "SELECT " + sqlApiKeyColumns + " FROM api_keys WHERE id = $1"
+	sqlTouchApiKey       = "UPDATE api_keys SET last_used_at = now() WHERE id = $1"
+	sqlRevokeApiKey      = "UPDATE api_keys SET revoked_at = coalesce(revoked_at, now()) WHERE id = $1 RETURNING " + sqlApiKeyColumns
+)
+
+// ErrApiKeyNotFound is returned when the api key does not exist
+var ErrApiKeyNotFound = errors.New("api key not found")
+
+// ApiKey is a stored api key of the user. The key itself is never stored, only its hash
+type ApiKey struct {
+	Id     int
+	UserId int
+	// Prefix is a beginning of the key to tell keys apart
+	Prefix     string
+	Name       string
+	Scopes     []string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+type IApiKeyRepository interface {
+	// CreateApiKey returns ErrUserNotFound, if the user does not exist
+	CreateApiKey(ctx context.Context, hash string, key ApiKey) (ApiKey, error)
+	// GetApiKeyByHash returns ErrApiKeyNotFound, if the key does not exist
+	GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error)
+	// GetApiKeyById returns ErrApiKeyNotFound, if the key does not exist
+	GetApiKeyById(ctx context.Context, id int) (ApiKey, error)
+	// TouchApiKey sets the last usage time of the key to now
+	TouchApiKey(ctx context.Context, id int) error
+	// RevokeApiKey returns ErrApiKeyNotFound, if the key does not exist
+	RevokeApiKey(ctx context.Context, id int) (ApiKey, error)
+}
+
+type DbApiKeyRepository struct {
+	db *sql.DB
+}
+
+func NewDbApiKeyRepository(db *sql.DB) *DbApiKeyRepository {
+	return &DbApiKeyRepository{db: db}
+}
+
+func (repo *DbApiKeyRepository) CreateApiKey(ctx context.Context, hash string, key ApiKey) (ApiKey, error) {
+	created, err := apiKeyFromRow(repo.db.QueryRowContext(ctx, sqlCreateApiKey,
+		key.UserId, hash, key.Prefix, key.Name, pq.Array(key.Scopes), key.ExpiresAt))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqForeignKeyViolation {
+		return ApiKey{}, ErrUserNotFound
+	}
+	return created, err
+}
+
+func (repo *DbApiKeyRepository) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	return apiKeyFromRow(repo.db.QueryRowContext(ctx, sqlQueryApiKeyByHash, hash))
+}
+
+func (repo *DbApiKeyRepository) GetApiKeyById(ctx context.Context, id int) (ApiKey, error) {
+	return apiKeyFromRow(repo.db.QueryRowContext(ctx, sqlQueryApiKeyById, id))
+}
+
+func (repo *DbApiKeyRepository) TouchApiKey(ctx context.Context, id int) error {
+	_, err := repo.db.ExecContext(ctx, sqlTouchApiKey, id)
+	return err
+}
+
+func (repo *DbApiKeyRepository) RevokeApiKey(ctx context.Context, id int) (ApiKey, error) {
+	return apiKeyFromRow(repo.db.QueryRowContext(ctx, sqlRevokeApiKey, id))
+}
+
+func apiKeyFromRow(row scanner) (key ApiKey, err error) {
+	err = row.Scan(&key.Id, &key.UserId, &key.Prefix, &key.Name, pq.Array(&key.Scopes),
+		&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ApiKey{}, ErrApiKeyNotFound
+	}
+	return
+}
+
+type ApiKeyRepositoryStub struct {
+	CreateApiKeyStub    func(ctx context.Context, hash string, key ApiKey) (ApiKey, error)
+	GetApiKeyByHashStub func(ctx context.Context, hash string) (ApiKey, error)
+	GetApiKeyByIdStub   func(ctx context.Context, id int) (ApiKey, error)
+	TouchApiKeyStub     func(ctx context.Context, id int) error
+	RevokeApiKeyStub    func(ctx context.Context, id int) (ApiKey, error)
+	RealAdapter         IApiKeyRepository
+}
+
+func (stub ApiKeyRepositoryStub) CreateApiKey(ctx context.Context, hash string, key ApiKey) (ApiKey, error) {
+	if stub.CreateApiKeyStub != nil {
+		return stub.CreateApiKeyStub(ctx, hash, key)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.CreateApiKey(ctx, hash, key)
+	}
+	panic("neither CreateApiKeyStub nor RealAdapter are assigned")
+}
+
+func (stub ApiKeyRepositoryStub) GetApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	if stub.GetApiKeyByHashStub != nil {
+		return stub.GetApiKeyByHashStub(ctx, hash)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetApiKeyByHash(ctx, hash)
+	}
+	panic("neither GetApiKeyByHashStub nor RealAdapter are assigned")
+}
+
+func (stub ApiKeyRepositoryStub) GetApiKeyById(ctx context.Context, id int) (ApiKey, error) {
+	if stub.GetApiKeyByIdStub != nil {
+		return stub.GetApiKeyByIdStub(ctx, id)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetApiKeyById(ctx, id)
+	}
+	panic("neither GetApiKeyByIdStub nor RealAdapter are assigned")
+}
+
+func (stub ApiKeyRepositoryStub) TouchApiKey(ctx context.Context, id int) error {
+	if stub.TouchApiKeyStub != nil {
+		return stub.TouchApiKeyStub(ctx, id)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.TouchApiKey(ctx, id)
+	}
+	panic("neither TouchApiKeyStub nor RealAdapter are assigned")
+}
+
+func (stub ApiKeyRepositoryStub) RevokeApiKey(ctx context.Context, id int) (ApiKey, error) {
+	if stub.RevokeApiKeyStub != nil {
+		return stub.RevokeApiKeyStub(ctx, id)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.RevokeApiKey(ctx, id)
+	}
+	panic("neither RevokeApiKeyStub nor RealAdapter are assigned")
+}
@@ -3,13 +3,37 @@ package domain
 import (
 	"context"
 	"database-service/cache"
+	"database-service/dbservice/api/logger"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
 )
 
 const (
-	sqlQueryDataByUser  = "SELECT * FROM data WHERE user_id = $1 order by id"
-	sqlQueryDataByAdmin = "SELECT * FROM data order by id"
+	sqlQueryDataByUser      = "SELECT * FROM data WHERE user_id = $1 order by id"
+	sqlQueryDataByAdmin     = "SELECT * FROM data order by id"
+	sqlQueryDataPageByUser  = "SELECT * FROM data WHERE user_id = $1 AND id > $2 order by id LIMIT $3"
+	sqlQueryDataPageByAdmin = "SELECT * FROM data WHERE id > $1 order by id LIMIT $2"
+	sqlQueryDataById        = "SELECT * FROM data WHERE id = $1"
+	sqlCreateData           = "INSERT INTO data (user_id, data) VALUES ($1, $2) RETURNING id, user_id, data"
+	sqlUpdateDataByUser     = "UPDATE data SET data = $3 WHERE id = $2 AND user_id = $1 RETURNING id, user_id, data"
+	sqlUpdateDataByAdmin    = "UPDATE data SET data = $2 WHERE id = $1 RETURNING id, user_id, data"
+	sqlDeleteDataByUser     = "DELETE FROM data WHERE id = $2 AND user_id = $1 RETURNING id, user_id, data"
+	sqlDeleteDataByAdmin    = "DELETE FROM data WHERE id = $1 RETURNING id, user_id, data"
+)
+
+const pqForeignKeyViolation = "23503"
+
+var (
+	// ErrDataNotFound is returned when the record does not exist or is not accessible by the user
+	ErrDataNotFound = errors.New("data not found")
+	// ErrDataOwnerNotFound is returned when the record is created for a user that does not exist
+	ErrDataOwnerNotFound = errors.New("data owner not found")
 )
 
 type Data interface {
@@ -37,8 +61,21 @@ func (d DbData) GetData() string {
 }
 
 type IDataRepository interface {
-	GetDataByUser(userId int) ([]Data, error)
-	GetDataByAdmin() ([]Data, error)
+	GetDataByUser(ctx context.Context, userId int) ([]Data, error)
+	GetDataByAdmin(ctx context.Context) ([]Data, error)
+	// GetDataPageByUser returns at most limit records of the user with id greater than afterId
+	GetDataPageByUser(ctx context.Context, userId int, afterId int, limit int) ([]Data, error)
+	// GetDataPageByAdmin returns at most limit records of all users with id greater than afterId
+	GetDataPageByAdmin(ctx context.Context, afterId int, limit int) ([]Data, error)
+	// GetDataById returns ErrDataNotFound if the record does not exist
+	GetDataById(ctx context.Context, id int) (Data, error)
+	CreateData(ctx context.Context, userId int, data string) (Data, error)
+	// UpdateDataByUser updates the record only if it belongs to the user
+	UpdateDataByUser(ctx context.Context, userId int, id int, data string) (Data, error)
+	UpdateDataByAdmin(ctx context.Context, id int, data string) (Data, error)
+	// DeleteDataByUser deletes the record only if it belongs to the user
+	DeleteDataByUser(ctx context.Context, userId int, id int) (Data, error)
+	DeleteDataByAdmin(ctx context.Context, id int) (Data, error)
 }
 
 type DbDataRepository struct {
@@ -49,22 +86,79 @@ func NewDbDataRepository(db *sql.DB) IDataRepository {
 	return &DbDataRepository{db: db}
 }
 
-func (repo *DbDataRepository) GetDataByUser(userId int) ([]Data, error) {
-	rows, err := repo.db.Query(sqlQueryDataByUser, userId)
+func (repo *DbDataRepository) GetDataByUser(ctx context.Context, userId int) ([]Data, error) {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryDataByUser, userId)
+	if err != nil {
+		return nil, err
+	}
+	return repo.dataFromRows(rows)
+}
+
+func (repo *DbDataRepository) GetDataByAdmin(ctx context.Context) ([]Data, error) {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryDataByAdmin)
 	if err != nil {
 		return nil, err
 	}
 	return repo.dataFromRows(rows)
 }
 
-func (repo *DbDataRepository) GetDataByAdmin() ([]Data, error) {
-	rows, err := repo.db.Query(sqlQueryDataByAdmin)
+func (repo *DbDataRepository) GetDataPageByUser(ctx context.Context, userId int, afterId int, limit int) ([]Data, error) {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryDataPageByUser, userId, afterId, limit)
 	if err != nil {
 		return nil, err
 	}
 	return repo.dataFromRows(rows)
 }
 
+func (repo *DbDataRepository) GetDataPageByAdmin(ctx context.Context, afterId int, limit int) ([]Data, error) {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryDataPageByAdmin, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return repo.dataFromRows(rows)
+}
+
+func (repo *DbDataRepository) GetDataById(ctx context.Context, id int) (Data, error) {
+	return repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlQueryDataById, id))
+}
+
+func (repo *DbDataRepository) CreateData(ctx context.Context, userId int, data string) (Data, error) {
+	d, err := repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlCreateData, userId, data))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqForeignKeyViolation {
+		return nil, ErrDataOwnerNotFound
+	}
+	return d, err
+}
+
+func (repo *DbDataRepository) UpdateDataByUser(ctx context.Context, userId int, id int, data string) (Data, error) {
+	return repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlUpdateDataByUser, userId, id, data))
+}
+
+func (repo *DbDataRepository) UpdateDataByAdmin(ctx context.Context, id int, data string) (Data, error) {
+	return repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlUpdateDataByAdmin, id, data))
+}
+
+func (repo *DbDataRepository) DeleteDataByUser(ctx context.Context, userId int, id int) (Data, error) {
+	return repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlDeleteDataByUser, userId, id))
+}
+
+func (repo *DbDataRepository) DeleteDataByAdmin(ctx context.Context, id int) (Data, error) {
+	return repo.dataFromRow(repo.db.QueryRowContext(ctx, sqlDeleteDataByAdmin, id))
+}
+
+func (repo *DbDataRepository) dataFromRow(row *sql.Row) (Data, error) {
+	var d DbData
+	err := row.Scan(&d.id, &d.userId, &d.data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDataNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
 func (repo *DbDataRepository) dataFromRows(rows *sql.Rows) ([]Data, error) {
 	defer rows.Close()
 
@@ -79,41 +173,351 @@ func (repo *DbDataRepository) dataFromRows(rows *sql.Rows) ([]Data, error) {
 		data = append(data, d)
 	}
 
-	return data, nil
+	return data, rows.Err()
 }
 
 type CachedDataRepository struct {
-	dbRepo    IDataRepository
-	cache     cache.Cache
-	keyPrefix string
+	dbRepo       IDataRepository
+	cache        cache.Cache
+	keyPrefix    string
+	logger       logger.Logger
+	options      CacheOptions
+	group        singleflight.Group
+	coalescedM   prometheus.Counter
+	cacheErrorsM *prometheus.CounterVec
+}
+
+// ErrCacheUnavailable is returned in fail-closed mode, when data can't be read from cache
+var ErrCacheUnavailable = errors.New("cache unavailable")
+
+const (
+	cacheOperationGet    = "get"
+	cacheOperationSet    = "set"
+	cacheOperationDelete = "delete"
+)
+
+type CacheOptions struct {
+	// SoftTTL enables stale-while-revalidate mode for lists: after SoftTTL the cached list is still returned,
+	// but refreshed in background. Zero disables the mode
+	SoftTTL time.Duration
+	// EmptyTTL is a ttl of cached empty lists, e.g. for users without data or unknown users. Zero means the default ttl.
+	// It must be at least a second, go-redis/cache replaces shorter ttl with an hour
+	EmptyTTL time.Duration
+	// FailClosed makes reads fail with ErrCacheUnavailable on cache errors instead of falling back to db.
+	// Errors of cache writes are only logged in both modes
+	FailClosed bool
+	// Background tracks db queries, which may outlive requests, e.g. revalidations of stale lists,
+	// so connections are closed after them. Nil leaves them untracked
+	Background *sync.WaitGroup
 }
 
-const keyFormat = `%s_%d`
+// Keys of the repository share dataKeyFormat, so purges of the data cache don't touch other keys of the service
+const (
+	dataKeyFormat    = `%s_data_`
+	keyFormat        = dataKeyFormat + `%d`
+	pageKeyFormat    = dataKeyFormat + `%d_page_%d_%d_%d`
+	pageGenKeyFormat = dataKeyFormat + `%d_page_gen`
+	recordKeyFormat  = dataKeyFormat + `record_%d`
+)
 
-func NewCachedDataRepository(dbRepo IDataRepository, cache cache.Cache, keyPrefix string) IDataRepository {
-	return &CachedDataRepository{dbRepo: dbRepo, cache: cache, keyPrefix: keyPrefix}
+func NewCachedDataRepository(dbRepo IDataRepository, cache cache.Cache, keyPrefix string, logger logger.Logger, options CacheOptions) *CachedDataRepository {
+	return &CachedDataRepository{
+		dbRepo:    dbRepo,
+		cache:     cache,
+		keyPrefix: keyPrefix,
+		logger:    logger,
+		options:   options,
+		coalescedM: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "database_service_cache_coalesced_calls_total",
+			Help: "database-service calls, which waited for the result of the same concurrent db query instead of running their own",
+		}),
+		cacheErrorsM: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "database_service_cache_errors_total",
+			Help: "database-service cache errors",
+		}, []string{"operation"}),
+	}
 }
 
-func (repo *CachedDataRepository) GetDataByUser(userId int) ([]Data, error) {
-	data, _ := repo.getFromCache(userId)
+// Collectors returns metrics of the repository to be registered
+func (repo *CachedDataRepository) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{repo.coalescedM, repo.cacheErrorsM}
+}
+
+func (repo *CachedDataRepository) GetDataByUser(ctx context.Context, userId int) ([]Data, error) {
+	key := repo.getKey(userId)
+	fetch := func(ctx context.Context) (interface{}, error) {
+		data, err := repo.dbRepo.GetDataByUser(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+		repo.logCacheError(cacheOperationSet, repo.setToCache(ctx, userId, data))
+		return data, nil
+	}
+	data, stale, err := repo.getFromCacheByKey(ctx, key)
+	if err = repo.checkReadError(err); err != nil {
+		return nil, err
+	}
 	if data != nil {
+		if stale {
+			repo.revalidate(ctx, key, fetch)
+		}
 		return data, nil
 	}
-	data, err := repo.dbRepo.GetDataByUser(userId)
-	_ = repo.setToCache(userId, data)
-	return data, err
+	v, err := repo.coalesce(ctx, key, fetch)
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Data), nil
 }
 
-func (repo *CachedDataRepository) GetDataByAdmin() ([]Data, error) {
-	data, err := repo.dbRepo.GetDataByAdmin()
+func (repo *CachedDataRepository) GetDataByAdmin(ctx context.Context) ([]Data, error) {
+	data, err := repo.dbRepo.GetDataByAdmin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	repo.updateUsersCache(data)
+	repo.updateUsersCache(ctx, data)
 	return data, err
 }
 
-func (repo *CachedDataRepository) updateUsersCache(data []Data) {
+func (repo *CachedDataRepository) GetDataPageByUser(ctx context.Context, userId int, afterId int, limit int) ([]Data, error) {
+	// the generation is read before the query, so a write during the query bumps it, and the page is not cached
+	gen, genErr := repo.getPageGen(ctx, userId)
+	repo.logCacheError(cacheOperationGet, genErr)
+	key := repo.getPageKey(userId, gen, afterId, limit)
+	fetch := func(ctx context.Context) (interface{}, error) {
+		data, err := repo.dbRepo.GetDataPageByUser(ctx, userId, afterId, limit)
+		if err != nil {
+			return nil, err
+		}
+		if genErr == nil {
+			repo.setPageToCache(ctx, userId, gen, key, data)
+		}
+		return data, nil
+	}
+	data, stale, err := repo.getFromCacheByKey(ctx, key)
+	if err = repo.checkReadError(err); err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if stale {
+			repo.revalidate(ctx, key, fetch)
+		}
+		return data, nil
+	}
+	v, err := repo.coalesce(ctx, key, fetch)
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Data), nil
+}
+
+// GetDataPageByAdmin is not cached: a single page may contain only a part of user's data,
+// so it can't be used to refresh users cache.
+func (repo *CachedDataRepository) GetDataPageByAdmin(ctx context.Context, afterId int, limit int) ([]Data, error) {
+	return repo.dbRepo.GetDataPageByAdmin(ctx, afterId, limit)
+}
+
+func (repo *CachedDataRepository) GetDataById(ctx context.Context, id int) (Data, error) {
+	var cacheData CacheData
+	err := repo.cache.Get(ctx, repo.getRecordKey(id), &cacheData)
+	if err = repo.checkReadError(err); err != nil {
+		return nil, err
+	}
+	if cacheData.Id != 0 {
+		return cacheData, nil
+	}
+	v, err := repo.coalesce(ctx, repo.getRecordKey(id), func(ctx context.Context) (interface{}, error) {
+		data, err := repo.dbRepo.GetDataById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		repo.logCacheError(cacheOperationSet, repo.setRecordToCache(ctx, id, data))
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(Data), nil
+}
+
+// isStale reports whether the list stored at storedAt is older than soft ttl
+func (repo *CachedDataRepository) isStale(storedAt int64) bool {
+	return repo.options.SoftTTL > 0 && time.Since(time.Unix(0, storedAt)) > repo.options.SoftTTL
+}
+
+// revalidate refreshes the key in background without waiting for the result. The refresh joins the in-flight fetch
+// of the same key, so there is at most one refresh per key. It outlives the request, but keeps its deadline
+func (repo *CachedDataRepository) revalidate(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) {
+	repo.doChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := detach(ctx)
+		defer cancel()
+		v, err := fetch(fetchCtx)
+		if err != nil {
+			repo.logger.Error(err)
+		}
+		return v, err
+	})
+}
+
+// checkReadError logs the cache read error. In fail-closed mode the error is returned to be passed to the caller
+func (repo *CachedDataRepository) checkReadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	repo.logCacheError(cacheOperationGet, err)
+	if repo.options.FailClosed {
+		return fmt.Errorf("%w: %v", ErrCacheUnavailable, err)
+	}
+	return nil
+}
+
+func (repo *CachedDataRepository) logCacheError(operation string, err error) {
+	if err == nil {
+		return
+	}
+	repo.cacheErrorsM.WithLabelValues(operation).Inc()
+	repo.logger.Error(fmt.Errorf("cache %s: %w", operation, err))
+}
+
+// coalesce runs fetch once for all concurrent calls with the same key, so a cold key produces only one db query.
+// The shared fetch is not canceled when one of the callers goes away, but keeps the deadline of the first caller
+func (repo *CachedDataRepository) coalesce(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	leader := false
+	ch := repo.doChan(key, func() (interface{}, error) {
+		leader = true
+		fetchCtx, cancel := detach(ctx)
+		defer cancel()
+		return fetch(fetchCtx)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if !leader {
+			repo.coalescedM.Inc()
+		}
+		return res.Val, res.Err
+	}
+}
+
+// doChan runs fn once for concurrent calls with the same key. fn is not canceled with the caller,
+// so the call is tracked by the Background group until it ends
+func (repo *CachedDataRepository) doChan(key string, fn func() (interface{}, error)) <-chan singleflight.Result {
+	ch := repo.group.DoChan(key, fn)
+	if repo.options.Background == nil {
+		return ch
+	}
+	// added before the caller returns, so a caller, which waits for the group after requests, doesn't miss the call
+	repo.options.Background.Add(1)
+	tracked := make(chan singleflight.Result, 1)
+	go func() {
+		defer repo.options.Background.Done()
+		tracked <- <-ch
+	}()
+	return tracked
+}
+
+// detach returns context, which is not canceled with the parent, but has the same deadline
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+func (repo *CachedDataRepository) CreateData(ctx context.Context, userId int, data string) (Data, error) {
+	d, err := repo.dbRepo.CreateData(ctx, userId, data)
+	return repo.afterWrite(ctx, d, err)
+}
+
+func (repo *CachedDataRepository) UpdateDataByUser(ctx context.Context, userId int, id int, data string) (Data, error) {
+	d, err := repo.dbRepo.UpdateDataByUser(ctx, userId, id, data)
+	return repo.afterWrite(ctx, d, err)
+}
+
+func (repo *CachedDataRepository) UpdateDataByAdmin(ctx context.Context, id int, data string) (Data, error) {
+	d, err := repo.dbRepo.UpdateDataByAdmin(ctx, id, data)
+	return repo.afterWrite(ctx, d, err)
+}
+
+func (repo *CachedDataRepository) DeleteDataByUser(ctx context.Context, userId int, id int) (Data, error) {
+	d, err := repo.dbRepo.DeleteDataByUser(ctx, userId, id)
+	return repo.afterDelete(ctx, d, err)
+}
+
+func (repo *CachedDataRepository) DeleteDataByAdmin(ctx context.Context, id int) (Data, error) {
+	d, err := repo.dbRepo.DeleteDataByAdmin(ctx, id)
+	return repo.afterDelete(ctx, d, err)
+}
+
+// afterWrite refreshes cache of the record and its owner, so readers get new data without waiting for ttl
+func (repo *CachedDataRepository) afterWrite(ctx context.Context, data Data, err error) (Data, error) {
+	if err != nil {
+		return nil, err
+	}
+	repo.logCacheError(cacheOperationSet, repo.setRecordToCache(ctx, data.GetId(), data))
+	repo.refreshUserCache(ctx, data.GetUserId())
+	return data, nil
+}
+
+func (repo *CachedDataRepository) afterDelete(ctx context.Context, data Data, err error) (Data, error) {
+	if err != nil {
+		return nil, err
+	}
+	repo.logCacheError(cacheOperationDelete, repo.InvalidateRecord(ctx, data.GetId()))
+	repo.refreshUserCache(ctx, data.GetUserId())
+	return data, nil
+}
+
+// InvalidateUser evicts cached list and pages of the user
+func (repo *CachedDataRepository) InvalidateUser(ctx context.Context, userId int) error {
+	if err := repo.invalidateUserPages(ctx, userId); err != nil {
+		return err
+	}
+	return repo.cache.Delete(ctx, repo.getKey(userId))
+}
+
+// InvalidateRecord evicts cached single record
+func (repo *CachedDataRepository) InvalidateRecord(ctx context.Context, id int) error {
+	return repo.cache.Delete(ctx, repo.getRecordKey(id))
+}
+
+// InvalidateRecords evicts cached records
+func (repo *CachedDataRepository) InvalidateRecords(ctx context.Context, ids ...int) error {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, repo.getRecordKey(id))
+	}
+	return repo.cache.Delete(ctx, keys...)
+}
+
+// PurgeUser deletes all cached entries of the user, including pages of previous generations
+func (repo *CachedDataRepository) PurgeUser(ctx context.Context, userId int) error {
+	if err := repo.cache.Delete(ctx, repo.getKey(userId)); err != nil {
+		return err
+	}
+	return repo.cache.InvalidatePrefix(ctx, repo.getKey(userId)+"_")
+}
+
+// PurgeAll deletes all cached entries of the repository. Cached users and revocations are kept
+func (repo *CachedDataRepository) PurgeAll(ctx context.Context) error {
+	return repo.cache.InvalidatePrefix(ctx, fmt.Sprintf(dataKeyFormat, repo.keyPrefix))
+}
+
+func (repo *CachedDataRepository) refreshUserCache(ctx context.Context, userId int) {
+	repo.logCacheError(cacheOperationSet, repo.invalidateUserPages(ctx, userId))
+	data, err := repo.dbRepo.GetDataByUser(ctx, userId)
+	if err != nil {
+		// cached list is outdated now, so it must not be served until ttl
+		repo.logger.Error(err)
+		repo.logCacheError(cacheOperationDelete, repo.cache.Delete(ctx, repo.getKey(userId)))
+		return
+	}
+	repo.logCacheError(cacheOperationSet, repo.setToCache(ctx, userId, data))
+}
+
+func (repo *CachedDataRepository) updateUsersCache(ctx context.Context, data []Data) {
 	//TODO Можно сделать тут воркеры
 	dataByUserId := make(map[int][]Data)
 	for _, d := range data {
@@ -122,15 +526,22 @@ func (repo *CachedDataRepository) updateUsersCache(data []Data) {
 		}
 		dataByUserId[d.GetUserId()] = append(dataByUserId[d.GetUserId()], d)
 	}
-	userIds := make([]int, len(dataByUserId))
+	userIds := make([]int, 0, len(dataByUserId))
 	for userId := range dataByUserId {
 		userIds = append(userIds, userId)
 	}
 	for _, id := range userIds {
-		_ = repo.setToCache(id, dataByUserId[id])
+		repo.logCacheError(cacheOperationSet, repo.setToCache(ctx, id, dataByUserId[id]))
+		repo.logCacheError(cacheOperationSet, repo.invalidateUserPages(ctx, id))
 	}
 }
 
+// invalidateUserPages bumps the generation of user's pages, so all previously cached pages
+// become unreachable and expire by ttl.
+func (repo *CachedDataRepository) invalidateUserPages(ctx context.Context, userId int) error {
+	return repo.cache.Set(ctx, repo.getPageGenKey(userId), time.Now().UnixNano())
+}
+
 type CacheData struct {
 	Id     int
 	UserId int
@@ -149,23 +560,36 @@ func (c CacheData) GetData() string {
 	return c.Data
 }
 
-func (repo *CachedDataRepository) getFromCache(userId int) ([]Data, error) {
-	var cacheData []CacheData
-	err := repo.cache.Get(context.Background(), repo.getKey(userId), &cacheData)
-	if err != nil {
-		return nil, err
+// CacheList is a cached list of records along with the time it was stored. An empty list is decoded as nil,
+// so a cache miss is told apart by zero StoredAt
+type CacheList struct {
+	Data []CacheData
+	// StoredAt is unix time in nanoseconds
+	StoredAt int64
+}
+
+// getFromCacheByKey returns nil data on a cache miss. stale reports whether the list is older than soft ttl
+func (repo *CachedDataRepository) getFromCacheByKey(ctx context.Context, key string) (data []Data, stale bool, err error) {
+	var cached CacheList
+	if err = repo.cache.Get(ctx, key, &cached); err != nil || cached.StoredAt == 0 {
+		return nil, false, err
 	}
-	if cacheData != nil {
-		var data = make([]Data, 0)
-		for _, cd := range cacheData {
-			data = append(data, cd)
-		}
-		return data, err
+	// a local cache may keep the empty list longer than its ttl
+	if len(cached.Data) == 0 && repo.options.EmptyTTL > 0 && time.Since(time.Unix(0, cached.StoredAt)) > repo.options.EmptyTTL {
+		return nil, false, nil
 	}
-	return nil, nil
+	data = make([]Data, 0, len(cached.Data))
+	for _, cd := range cached.Data {
+		data = append(data, cd)
+	}
+	return data, repo.isStale(cached.StoredAt), nil
+}
+
+func (repo *CachedDataRepository) setToCache(ctx context.Context, userId int, data []Data) error {
+	return repo.setToCacheByKey(ctx, repo.getKey(userId), data)
 }
 
-func (repo *CachedDataRepository) setToCache(userId int, data []Data) error {
+func (repo *CachedDataRepository) setToCacheByKey(ctx context.Context, key string, data []Data) error {
 	cacheData := make([]CacheData, len(data))
 	for i, d := range data {
 		cacheData[i] = CacheData{
@@ -174,33 +598,158 @@ func (repo *CachedDataRepository) setToCache(userId int, data []Data) error {
 			Data:   d.GetData(),
 		}
 	}
-	return repo.cache.Set(context.Background(), repo.getKey(userId), cacheData)
+	cached := CacheList{Data: cacheData, StoredAt: time.Now().UnixNano()}
+	if len(cacheData) == 0 && repo.options.EmptyTTL > 0 {
+		return repo.cache.SetWithTTL(ctx, key, cached, repo.options.EmptyTTL)
+	}
+	return repo.cache.Set(ctx, key, cached)
+}
+
+// setPageToCache caches the page of generation gen, unless the generation has changed since then
+func (repo *CachedDataRepository) setPageToCache(ctx context.Context, userId int, gen int64, key string, data []Data) {
+	current, err := repo.getPageGen(ctx, userId)
+	if err != nil {
+		repo.logCacheError(cacheOperationGet, err)
+		return
+	}
+	if current != gen {
+		return
+	}
+	repo.logCacheError(cacheOperationSet, repo.setToCacheByKey(ctx, key, data))
+}
+
+func (repo *CachedDataRepository) setRecordToCache(ctx context.Context, id int, data Data) error {
+	cacheData := CacheData{
+		Id:     data.GetId(),
+		UserId: data.GetUserId(),
+		Data:   data.GetData(),
+	}
+	return repo.cache.Set(ctx, repo.getRecordKey(id), cacheData)
+}
+
+func (repo *CachedDataRepository) getRecordKey(id int) string {
+	return fmt.Sprintf(recordKeyFormat, repo.keyPrefix, id)
 }
 
 func (repo *CachedDataRepository) getKey(userId int) string {
 	return fmt.Sprintf(keyFormat, repo.keyPrefix, userId)
 }
 
+func (repo *CachedDataRepository) getPageKey(userId int, gen int64, afterId int, limit int) string {
+	return fmt.Sprintf(pageKeyFormat, repo.keyPrefix, userId, gen, afterId, limit)
+}
+
+// getPageGen returns the current generation of user's pages, zero if pages were never invalidated
+func (repo *CachedDataRepository) getPageGen(ctx context.Context, userId int) (int64, error) {
+	var gen int64
+	err := repo.cache.Get(ctx, repo.getPageGenKey(userId), &gen)
+	return gen, err
+}
+
+func (repo *CachedDataRepository) getPageGenKey(userId int) string {
+	return fmt.Sprintf(pageGenKeyFormat, repo.keyPrefix, userId)
+}
+
 type DataRepositoryStub struct {
-	GetDataByUserStub  func(userId int) ([]Data, error)
-	GetDataByAdminStub func() ([]Data, error)
-	RealAdapter        IDataRepository
+	GetDataByUserStub      func(ctx context.Context, userId int) ([]Data, error)
+	GetDataByAdminStub     func(ctx context.Context) ([]Data, error)
+	GetDataPageByUserStub  func(ctx context.Context, userId int, afterId int, limit int) ([]Data, error)
+	GetDataPageByAdminStub func(ctx context.Context, afterId int, limit int) ([]Data, error)
+	GetDataByIdStub        func(ctx context.Context, id int) (Data, error)
+	CreateDataStub         func(ctx context.Context, userId int, data string) (Data, error)
+	UpdateDataByUserStub   func(ctx context.Context, userId int, id int, data string) (Data, error)
+	UpdateDataByAdminStub  func(ctx context.Context, id int, data string) (Data, error)
+	DeleteDataByUserStub   func(ctx context.Context, userId int, id int) (Data, error)
+	DeleteDataByAdminStub  func(ctx context.Context, id int) (Data, error)
+	RealAdapter            IDataRepository
 }
 
-func (stub DataRepositoryStub) GetDataByUser(userId int) ([]Data, error) {
+func (stub DataRepositoryStub) GetDataByUser(ctx context.Context, userId int) ([]Data, error) {
 	if stub.GetDataByUserStub != nil {
-		return stub.GetDataByUserStub(userId)
+		return stub.GetDataByUserStub(ctx, userId)
 	} else if stub.RealAdapter != nil {
-		return stub.RealAdapter.GetDataByUser(userId)
+		return stub.RealAdapter.GetDataByUser(ctx, userId)
 	}
 	panic("neither stub nor RealAdapter is set for GetDataByUser")
 }
 
-func (stub DataRepositoryStub) GetDataByAdmin() ([]Data, error) {
+func (stub DataRepositoryStub) GetDataByAdmin(ctx context.Context) ([]Data, error) {
 	if stub.GetDataByAdminStub != nil {
-		return stub.GetDataByAdminStub()
+		return stub.GetDataByAdminStub(ctx)
 	} else if stub.RealAdapter != nil {
-		return stub.RealAdapter.GetDataByAdmin()
+		return stub.RealAdapter.GetDataByAdmin(ctx)
 	}
 	panic("neither stub nor RealAdapter is set for GetDataByAdmin")
 }
+
+func (stub DataRepositoryStub) GetDataPageByUser(ctx context.Context, userId int, afterId int, limit int) ([]Data, error) {
+	if stub.GetDataPageByUserStub != nil {
+		return stub.GetDataPageByUserStub(ctx, userId, afterId, limit)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetDataPageByUser(ctx, userId, afterId, limit)
+	}
+	panic("neither stub nor RealAdapter is set for GetDataPageByUser")
+}
+
+func (stub DataRepositoryStub) GetDataPageByAdmin(ctx context.Context, afterId int, limit int) ([]Data, error) {
+	if stub.GetDataPageByAdminStub != nil {
+		return stub.GetDataPageByAdminStub(ctx, afterId, limit)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetDataPageByAdmin(ctx, afterId, limit)
+	}
+	panic("neither stub nor RealAdapter is set for GetDataPageByAdmin")
+}
+
+func (stub DataRepositoryStub) GetDataById(ctx context.Context, id int) (Data, error) {
+	if stub.GetDataByIdStub != nil {
+		return stub.GetDataByIdStub(ctx, id)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetDataById(ctx, id)
+	}
+	panic("neither stub nor RealAdapter is set for GetDataById")
+}
+
+func (stub DataRepositoryStub) CreateData(ctx context.Context, userId int, data string) (Data, error) {
+	if stub.CreateDataStub != nil {
+		return stub.CreateDataStub(ctx, userId, data)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.CreateData(ctx, userId, data)
+	}
+	panic("neither stub nor RealAdapter is set for CreateData")
+}
+
+func (stub DataRepositoryStub) UpdateDataByUser(ctx context.Context, userId int, id int, data string) (Data, error) {
+	if stub.UpdateDataByUserStub != nil {
+		return stub.UpdateDataByUserStub(ctx, userId, id, data)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.UpdateDataByUser(ctx, userId, id, data)
+	}
+	panic("neither stub nor RealAdapter is set for UpdateDataByUser")
+}
+
+func (stub DataRepositoryStub) UpdateDataByAdmin(ctx context.Context, id int, data string) (Data, error) {
+	if stub.UpdateDataByAdminStub != nil {
+		return stub.UpdateDataByAdminStub(ctx, id, data)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.UpdateDataByAdmin(ctx, id, data)
+	}
+	panic("neither stub nor RealAdapter is set for UpdateDataByAdmin")
+}
+
+func (stub DataRepositoryStub) DeleteDataByUser(ctx context.Context, userId int, id int) (Data, error) {
+	if stub.DeleteDataByUserStub != nil {
+		return stub.DeleteDataByUserStub(ctx, userId, id)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.DeleteDataByUser(ctx, userId, id)
+	}
+	panic("neither stub nor RealAdapter is set for DeleteDataByUser")
+}
+
+func (stub DataRepositoryStub) DeleteDataByAdmin(ctx context.Context, id int) (Data, error) {
+	if stub.DeleteDataByAdminStub != nil {
+		return stub.DeleteDataByAdminStub(ctx, id)
+	} else if stub.RealAdapter != nil {
+		return stub.RealAdapter.DeleteDataByAdmin(ctx, id)
+	}
+	panic("neither stub nor RealAdapter is set for DeleteDataByAdmin")
+}
@@ -0,0 +1,33 @@
+package domain
+
+import "slices"
+
+// Permissions granted by roles of users
+const (
+	PermissionDataReadOwn  = "data:read:own"
+	PermissionDataReadAll  = "data:read:all"
+	PermissionDataWriteOwn = "data:write:own"
+	PermissionDataWriteAll = "data:write:all"
+	PermissionUsersManage  = "users:manage"
+)
+
+// Permissions is a set of permissions of the user
+type Permissions []string
+
+func (permissions Permissions) Has(permission string) bool {
+	return slices.Contains(permissions, permission)
+}
+
+// Intersect limits permissions by scopes of the token. Empty scopes don't limit them
+func (permissions Permissions) Intersect(scopes []string) Permissions {
+	if len(scopes) == 0 {
+		return permissions
+	}
+	result := make(Permissions, 0, len(permissions))
+	for _, permission := range permissions {
+		if slices.Contains(scopes, permission) {
+			result = append(result, permission)
+		}
+	}
+	return result
+}
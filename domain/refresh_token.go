@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	sqlCreateRefreshToken = `INSERT INTO refresh_tokens
+		(token_hash, family_id, user_id, scopes, source_jti, access_jti, access_expires_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	sqlUseRefreshToken = `UPDATE refresh_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL
+		RETURNING family_id, user_id, scopes, source_jti, access_jti, access_expires_at, expires_at, used_at, revoked_at, created_at`
+	sqlQueryRefreshToken = `SELECT family_id, user_id, scopes, source_jti, access_jti, access_expires_at, expires_at, used_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = $1`
+	sqlDeleteExpiredRefreshTokens = "DELETE FROM refresh_tokens WHERE expires_at <= now()"
+	sqlRevokeRefreshTokenFamily   = `UPDATE refresh_tokens SET revoked_at = coalesce(revoked_at, now()) WHERE family_id = $1
+		RETURNING family_id, user_id, scopes, source_jti, access_jti, access_expires_at, expires_at, used_at, revoked_at, created_at`
+	sqlRevokeRefreshTokensBySource = `UPDATE refresh_tokens SET revoked_at = coalesce(revoked_at, now()) WHERE source_jti = $1
+		RETURNING family_id, user_id, scopes, source_jti, access_jti, access_expires_at, expires_at, used_at, revoked_at, created_at`
+)
+
+var (
+	// ErrRefreshTokenNotFound is returned when the refresh token does not exist
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	// ErrRefreshTokenUsed is returned when the refresh token was already exchanged or revoked
+	ErrRefreshTokenUsed = errors.New("refresh token is already used")
+)
+
+// RefreshToken is a stored refresh token. Tokens rotated from each other share the FamilyId
+type RefreshToken struct {
+	FamilyId string
+	UserId   int
+	// Scopes of tokens issued by the refresh token
+	Scopes []string
+	// SourceJti is a jti of the provider token the family was issued by, all tokens of the family share it
+	SourceJti string
+	// AccessJti is a jti of the access token issued along with the refresh token
+	AccessJti       string
+	AccessExpiresAt time.Time
+	ExpiresAt       time.Time
+	UsedAt          *time.Time
+	RevokedAt       *time.Time
+	// CreatedAt is set by the repository
+	CreatedAt time.Time
+}
+
+// IRefreshTokenRepository stores refresh tokens by the hash, the token itself is never stored
+type IRefreshTokenRepository interface {
+	// CreateRefreshToken returns ErrUserNotFound, if the user does not exist
+	CreateRefreshToken(ctx context.Context, hash string, token RefreshToken) error
+	// RotateRefreshToken marks the token as used and stores the token returned by next in one transaction,
+	// so the used token stays valid, if next or the insert fails. If the token was already used or revoked,
+	// it is returned along with ErrRefreshTokenUsed and next is not called
+	RotateRefreshToken(ctx context.Context, hash string, next func(used RefreshToken) (string, RefreshToken, error)) (RefreshToken, error)
+	// RevokeRefreshTokenFamily revokes all tokens of the family and returns them
+	RevokeRefreshTokenFamily(ctx context.Context, familyId string) ([]RefreshToken, error)
+	// RevokeRefreshTokensBySource revokes all tokens of families issued by the token with sourceJti and returns them
+	RevokeRefreshTokensBySource(ctx context.Context, sourceJti string) ([]RefreshToken, error)
+}
+
+type DbRefreshTokenRepository struct {
+	db *sql.DB
+}
+
+func NewDbRefreshTokenRepository(db *sql.DB) *DbRefreshTokenRepository {
+	return &DbRefreshTokenRepository{db: db}
+}
+
+func (repo *DbRefreshTokenRepository) CreateRefreshToken(ctx context.Context, hash string, token RefreshToken) error {
+	return createRefreshToken(ctx, repo.db, hash, token)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func createRefreshToken(ctx context.Context, db execer, hash string, token RefreshToken) error {
+	if token.Scopes == nil {
+		token.Scopes = []string{}
+	}
+	_, err := db.ExecContext(ctx, sqlCreateRefreshToken,
+		hash, token.FamilyId, token.UserId, pq.Array(token.Scopes), token.SourceJti, token.AccessJti, token.AccessExpiresAt, token.ExpiresAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqForeignKeyViolation {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (repo *DbRefreshTokenRepository) RotateRefreshToken(ctx context.Context, hash string,
+	next func(used RefreshToken) (string, RefreshToken, error)) (RefreshToken, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// the row stays locked until the end of the transaction, so concurrent rotations of the token wait for it
+	token, err := refreshTokenFromRow(tx.QueryRowContext(ctx, sqlUseRefreshToken, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		token, err = refreshTokenFromRow(tx.QueryRowContext(ctx, sqlQueryRefreshToken, hash))
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, ErrRefreshTokenNotFound
+		}
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return token, ErrRefreshTokenUsed
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	nextHash, nextToken, err := next(token)
+	if err != nil {
+		return token, err
+	}
+	if err = createRefreshToken(ctx, tx, nextHash, nextToken); err != nil {
+		return token, err
+	}
+	return token, tx.Commit()
+}
+
+func (repo *DbRefreshTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, familyId string) ([]RefreshToken, error) {
+	return repo.revokeRefreshTokens(ctx, sqlRevokeRefreshTokenFamily, familyId)
+}
+
+func (repo *DbRefreshTokenRepository) RevokeRefreshTokensBySource(ctx context.Context, sourceJti string) ([]RefreshToken, error) {
+	return repo.revokeRefreshTokens(ctx, sqlRevokeRefreshTokensBySource, sourceJti)
+}
+
+func (repo *DbRefreshTokenRepository) revokeRefreshTokens(ctx context.Context, query string, arg string) ([]RefreshToken, error) {
+	rows, err := repo.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []RefreshToken
+	for rows.Next() {
+		token, err := refreshTokenFromRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteExpired removes expired refresh tokens
+func (repo *DbRefreshTokenRepository) DeleteExpired(ctx context.Context) error {
+	_, err := repo.db.ExecContext(ctx, sqlDeleteExpiredRefreshTokens)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func refreshTokenFromRow(row scanner) (token RefreshToken, err error) {
+	err = row.Scan(&token.FamilyId, &token.UserId, pq.Array(&token.Scopes), &token.SourceJti, &token.AccessJti, &token.AccessExpiresAt, &token.ExpiresAt,
+		&token.UsedAt, &token.RevokedAt, &token.CreatedAt)
+	return
+}
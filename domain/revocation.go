@@ -0,0 +1,342 @@
+package domain
+
+import (
+	"context"
+	"database-service/dbservice/api/logger"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+const (
+	sqlRevokeToken = `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at)`
+	sqlRevokeUserTokens = `INSERT INTO user_token_revocations (user_id, revoked_before) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = GREATEST(user_token_revocations.revoked_before, EXCLUDED.revoked_before)`
+	sqlQueryTokenRevoked       = "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > now())"
+	sqlQueryUserRevokedBefore  = "SELECT revoked_before FROM user_token_revocations WHERE user_id = $1"
+	sqlQueryActiveTokens       = "SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > now()"
+	sqlQueryUserRevocations    = "SELECT user_id, revoked_before FROM user_token_revocations"
+	sqlDeleteExpiredRevocation = "DELETE FROM revoked_tokens WHERE expires_at <= now()"
+)
+
+// IRevocationRepository stores revoked tokens by jti and revocations of all tokens of the user
+type IRevocationRepository interface {
+	// RevokeToken revokes the token until expiresAt, after that the token is expired anyway
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// RevokeUserTokens revokes all tokens of the user issued not after before.
+	// Returns ErrUserNotFound, if the user does not exist
+	RevokeUserTokens(ctx context.Context, userId int, before time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	// GetUserRevokedBefore returns zero time, if tokens of the user were never revoked
+	GetUserRevokedBefore(ctx context.Context, userId int) (time.Time, error)
+}
+
+type DbRevocationRepository struct {
+	db *sql.DB
+}
+
+func NewDbRevocationRepository(db *sql.DB) *DbRevocationRepository {
+	return &DbRevocationRepository{db: db}
+}
+
+func (repo *DbRevocationRepository) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := repo.db.ExecContext(ctx, sqlRevokeToken, jti, expiresAt)
+	return err
+}
+
+func (repo *DbRevocationRepository) RevokeUserTokens(ctx context.Context, userId int, before time.Time) error {
+	_, err := repo.db.ExecContext(ctx, sqlRevokeUserTokens, userId, before)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqForeignKeyViolation {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (repo *DbRevocationRepository) IsTokenRevoked(ctx context.Context, jti string) (revoked bool, err error) {
+	err = repo.db.QueryRowContext(ctx, sqlQueryTokenRevoked, jti).Scan(&revoked)
+	return
+}
+
+func (repo *DbRevocationRepository) GetUserRevokedBefore(ctx context.Context, userId int) (time.Time, error) {
+	var before time.Time
+	err := repo.db.QueryRowContext(ctx, sqlQueryUserRevokedBefore, userId).Scan(&before)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return before, err
+}
+
+// DeleteExpired removes revocations of tokens, which are expired anyway
+func (repo *DbRevocationRepository) DeleteExpired(ctx context.Context) error {
+	_, err := repo.db.ExecContext(ctx, sqlDeleteExpiredRevocation)
+	return err
+}
+
+// CopyTo writes all active revocations to the other repository
+func (repo *DbRevocationRepository) CopyTo(ctx context.Context, other IRevocationRepository) error {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryActiveTokens)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err = rows.Scan(&jti, &expiresAt); err != nil {
+			return err
+		}
+		if err = other.RevokeToken(ctx, jti, expiresAt); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	userRows, err := repo.db.QueryContext(ctx, sqlQueryUserRevocations)
+	if err != nil {
+		return err
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		var userId int
+		var before time.Time
+		if err = userRows.Scan(&userId, &before); err != nil {
+			return err
+		}
+		if err = other.RevokeUserTokens(ctx, userId, before); err != nil {
+			return err
+		}
+	}
+	return userRows.Err()
+}
+
+// ErrRevocationsNotSynced is returned by RedisRevocationRepository, if redis has lost the revocations copied from the db,
+// e.g. after a restart without persistence or a flush, until they are copied again
+var ErrRevocationsNotSynced = errors.New("revocations are not synced to redis")
+
+// RedisRevocationRepository keeps revocations under "<keyPrefix>:", which no prefix of cache keys "<keyPrefix>_"
+// matches, so purges of the cache don't delete them. A marker key records that revocations of the db are copied,
+// a miss is reported as ErrRevocationsNotSynced without the marker
+// SyncTo copies all active revocations to redis and marks them synced, unless they are synced already.
+// Revocations written in between are written to both repositories by FallbackRevocationRepository
+func (repo *DbRevocationRepository) SyncTo(ctx context.Context, redisRepo *RedisRevocationRepository) error {
+	synced, err := redisRepo.IsSynced(ctx)
+	if err != nil || synced {
+		return err
+	}
+	if err = repo.CopyTo(ctx, redisRepo); err != nil {
+		return err
+	}
+	return redisRepo.MarkSynced(ctx)
+}
+
+type RedisRevocationRepository struct {
+	redis     *redis.Client
+	keyPrefix string
+}
+
+func NewRedisRevocationRepository(redis *redis.Client, keyPrefix string) *RedisRevocationRepository {
+	return &RedisRevocationRepository{redis: redis, keyPrefix: keyPrefix}
+}
+
+func (repo *RedisRevocationRepository) tokenKey(jti string) string {
+	return fmt.Sprintf("%s:revoked_token:%s", repo.keyPrefix, jti)
+}
+
+func (repo *RedisRevocationRepository) userKey(userId int) string {
+	return fmt.Sprintf("%s:revoked_user:%d", repo.keyPrefix, userId)
+}
+
+func (repo *RedisRevocationRepository) syncedKey() string {
+	return fmt.Sprintf("%s:revocations_synced", repo.keyPrefix)
+}
+
+// MarkSynced records that all revocations of the db are copied to redis
+func (repo *RedisRevocationRepository) MarkSynced(ctx context.Context) error {
+	return repo.redis.Set(ctx, repo.syncedKey(), 1, 0).Err()
+}
+
+// IsSynced reports whether revocations of the db are copied to redis and not lost since then
+func (repo *RedisRevocationRepository) IsSynced(ctx context.Context) (bool, error) {
+	n, err := repo.redis.Exists(ctx, repo.syncedKey()).Result()
+	return n > 0, err
+}
+
+func (repo *RedisRevocationRepository) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return repo.redis.Set(ctx, repo.tokenKey(jti), 1, ttl).Err()
+}
+
+// RevokeUserTokens doesn't check the user, it is done by the db repository
+func (repo *RedisRevocationRepository) RevokeUserTokens(ctx context.Context, userId int, before time.Time) error {
+	key := repo.userKey(userId)
+	value := before.UnixNano()
+	// keep the latest revocation, if there are concurrent ones
+	return repo.redis.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if current >= value {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, value, 0).Err()
+		})
+		return err
+	}, key)
+}
+
+func (repo *RedisRevocationRepository) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked, synced *redis.IntCmd
+	_, err := repo.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		revoked = pipe.Exists(ctx, repo.tokenKey(jti))
+		synced = pipe.Exists(ctx, repo.syncedKey())
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if revoked.Val() > 0 {
+		return true, nil
+	}
+	if synced.Val() == 0 {
+		return false, ErrRevocationsNotSynced
+	}
+	return false, nil
+}
+
+func (repo *RedisRevocationRepository) GetUserRevokedBefore(ctx context.Context, userId int) (time.Time, error) {
+	var value *redis.StringCmd
+	var synced *redis.IntCmd
+	_, err := repo.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		value = pipe.Get(ctx, repo.userKey(userId))
+		synced = pipe.Exists(ctx, repo.syncedKey())
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		if err = synced.Err(); err != nil {
+			return time.Time{}, err
+		}
+		if synced.Val() == 0 {
+			return time.Time{}, ErrRevocationsNotSynced
+		}
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(value.Val(), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// FallbackRevocationRepository reads revocations from the primary repository (redis) and falls back to
+// the durable one (db), if the primary fails, including ErrRevocationsNotSynced. Revocations are written to both of them
+type FallbackRevocationRepository struct {
+	primary  IRevocationRepository
+	fallback IRevocationRepository
+	logger   logger.Logger
+}
+
+func NewFallbackRevocationRepository(primary IRevocationRepository, fallback IRevocationRepository, logger logger.Logger) *FallbackRevocationRepository {
+	return &FallbackRevocationRepository{primary: primary, fallback: fallback, logger: logger}
+}
+
+func (repo *FallbackRevocationRepository) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := repo.fallback.RevokeToken(ctx, jti, expiresAt); err != nil {
+		return err
+	}
+	if err := repo.primary.RevokeToken(ctx, jti, expiresAt); err != nil {
+		repo.logger.Error(fmt.Errorf("revoke token in primary repository: %w", err))
+	}
+	return nil
+}
+
+func (repo *FallbackRevocationRepository) RevokeUserTokens(ctx context.Context, userId int, before time.Time) error {
+	if err := repo.fallback.RevokeUserTokens(ctx, userId, before); err != nil {
+		return err
+	}
+	if err := repo.primary.RevokeUserTokens(ctx, userId, before); err != nil {
+		repo.logger.Error(fmt.Errorf("revoke user tokens in primary repository: %w", err))
+	}
+	return nil
+}
+
+func (repo *FallbackRevocationRepository) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	revoked, err := repo.primary.IsTokenRevoked(ctx, jti)
+	if err == nil {
+		return revoked, nil
+	}
+	repo.logger.Error(fmt.Errorf("check token in primary repository: %w", err))
+	return repo.fallback.IsTokenRevoked(ctx, jti)
+}
+
+func (repo *FallbackRevocationRepository) GetUserRevokedBefore(ctx context.Context, userId int) (time.Time, error) {
+	before, err := repo.primary.GetUserRevokedBefore(ctx, userId)
+	if err == nil {
+		return before, nil
+	}
+	repo.logger.Error(fmt.Errorf("check user tokens in primary repository: %w", err))
+	return repo.fallback.GetUserRevokedBefore(ctx, userId)
+}
+
+type RevocationRepositoryStub struct {
+	RevokeTokenStub          func(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeUserTokensStub     func(ctx context.Context, userId int, before time.Time) error
+	IsTokenRevokedStub       func(ctx context.Context, jti string) (bool, error)
+	GetUserRevokedBeforeStub func(ctx context.Context, userId int) (time.Time, error)
+	RealAdapter              IRevocationRepository
+}
+
+func (stub RevocationRepositoryStub) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if stub.RevokeTokenStub != nil {
+		return stub.RevokeTokenStub(ctx, jti, expiresAt)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.RevokeToken(ctx, jti, expiresAt)
+	}
+	panic("neither RevokeTokenStub nor RealAdapter are assigned")
+}
+
+func (stub RevocationRepositoryStub) RevokeUserTokens(ctx context.Context, userId int, before time.Time) error {
+	if stub.RevokeUserTokensStub != nil {
+		return stub.RevokeUserTokensStub(ctx, userId, before)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.RevokeUserTokens(ctx, userId, before)
+	}
+	panic("neither RevokeUserTokensStub nor RealAdapter are assigned")
+}
+
+func (stub RevocationRepositoryStub) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if stub.IsTokenRevokedStub != nil {
+		return stub.IsTokenRevokedStub(ctx, jti)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.IsTokenRevoked(ctx, jti)
+	}
+	panic("neither IsTokenRevokedStub nor RealAdapter are assigned")
+}
+
+func (stub RevocationRepositoryStub) GetUserRevokedBefore(ctx context.Context, userId int) (time.Time, error) {
+	if stub.GetUserRevokedBeforeStub != nil {
+		return stub.GetUserRevokedBeforeStub(ctx, userId)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetUserRevokedBefore(ctx, userId)
+	}
+	panic("neither GetUserRevokedBeforeStub nor RealAdapter are assigned")
+}
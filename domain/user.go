@@ -1,46 +1,296 @@
 package domain
 
 import (
+	"context"
+	"database-service/cache"
 	"database-service/dbservice/api/logger"
 	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
 )
 
-const AdminUserLevel = "admin"
+const (
+	UserLevel      = "user"
+	AdminUserLevel = "admin"
+)
+
+const (
+	sqlQueryAccessLevel = "SELECT access_level FROM users WHERE id = $1 AND deactivated_at IS NULL"
+	// sqlQueryUserPermissions selects permissions of the base role of the user, which is its access level, and of its other roles.
+	// No rows are selected for unknown users
+	sqlQueryUserPermissions = `SELECT coalesce(array_agg(DISTINCT rp.permission ORDER BY rp.permission)
+		FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM users u
+		LEFT JOIN role_permissions rp
+			ON rp.role = u.access_level::text OR rp.role IN (SELECT ur.role FROM user_roles ur WHERE ur.user_id = u.id)
+		WHERE u.id = $1 AND u.deactivated_at IS NULL
+		GROUP BY u.id`
+	sqlUserColumns       = "id, access_level, deactivated_at"
+	sqlQueryUsersPage    = "SELECT " + sqlUserColumns + " FROM users WHERE id > $1 ORDER BY id LIMIT $2"
+	sqlCreateUser        = "INSERT INTO users (access_level) VALUES ($1) RETURNING " + sqlUserColumns
+	sqlUpdateAccessLevel = "UPDATE users SET access_level = $2 WHERE id = $1 RETURNING " + sqlUserColumns
+	sqlDeactivateUser    = "UPDATE users SET deactivated_at = coalesce(deactivated_at, now()) WHERE id = $1 RETURNING " + sqlUserColumns
+)
+
+var (
+	// ErrUserNotFound is returned when the user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidAccessLevel is returned when the access level is neither UserLevel nor AdminUserLevel
+	ErrInvalidAccessLevel = errors.New("invalid access level")
+)
 
+// IUserRepository looks up users authenticated by tokens. Deactivated users are reported as not found
 type IUserRepository interface {
-	IsAdmin(userId int) bool
+	// GetAccessLevel returns ErrUserNotFound, if the user does not exist
+	GetAccessLevel(ctx context.Context, userId int) (string, error)
+	// GetPermissions returns permissions of all roles of the user or ErrUserNotFound, if the user does not exist
+	GetPermissions(ctx context.Context, userId int) (Permissions, error)
+}
+
+// User is a user managed by admins
+type User struct {
+	Id            int
+	AccessLevel   string
+	DeactivatedAt *time.Time
+}
+
+// IUserManagementRepository manages users, including deactivated ones
+type IUserManagementRepository interface {
+	// ListUsers returns at most limit users with id greater than afterId
+	ListUsers(ctx context.Context, afterId int, limit int) ([]User, error)
+	// CreateUser returns ErrInvalidAccessLevel, if the access level is unknown
+	CreateUser(ctx context.Context, accessLevel string) (User, error)
+	// UpdateAccessLevel returns ErrUserNotFound or ErrInvalidAccessLevel
+	UpdateAccessLevel(ctx context.Context, userId int, accessLevel string) (User, error)
+	// DeactivateUser keeps the time of the first deactivation and revokes tokens of the user issued not after revokeBefore
+	// in the same transaction. Returns ErrUserNotFound, if the user does not exist
+	DeactivateUser(ctx context.Context, userId int, revokeBefore time.Time) (User, error)
 }
 
 type UserRepository struct {
-	db     *sql.DB
-	logger logger.Logger
+	db *sql.DB
 }
 
-func NewUserRepository(db *sql.DB, logger logger.Logger) IUserRepository {
-	return &UserRepository{db: db, logger: logger}
+func NewUserRepository(db *sql.DB) IUserRepository {
+	return &UserRepository{db: db}
 }
 
-func (repo UserRepository) IsAdmin(userId int) bool {
-	row := repo.db.QueryRow(`SELECT access_level FROM users WHERE id = $1`, userId)
+func (repo UserRepository) GetAccessLevel(ctx context.Context, userId int) (string, error) {
 	var accessLevel string
-	err := row.Scan(&accessLevel)
+	err := repo.db.QueryRowContext(ctx, sqlQueryAccessLevel, userId).Scan(&accessLevel)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	return accessLevel, err
+}
+
+func (repo UserRepository) GetPermissions(ctx context.Context, userId int) (Permissions, error) {
+	var permissions []string
+	err := repo.db.QueryRowContext(ctx, sqlQueryUserPermissions, userId).Scan(pq.Array(&permissions))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+type DbUserManagementRepository struct {
+	db *sql.DB
+}
+
+func NewDbUserManagementRepository(db *sql.DB) *DbUserManagementRepository {
+	return &DbUserManagementRepository{db: db}
+}
+
+func (repo *DbUserManagementRepository) ListUsers(ctx context.Context, afterId int, limit int) ([]User, error) {
+	rows, err := repo.db.QueryContext(ctx, sqlQueryUsersPage, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		user, err := userFromRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (repo *DbUserManagementRepository) CreateUser(ctx context.Context, accessLevel string) (User, error) {
+	if !isAccessLevel(accessLevel) {
+		return User{}, ErrInvalidAccessLevel
+	}
+	return userFromRow(repo.db.QueryRowContext(ctx, sqlCreateUser, accessLevel))
+}
+
+func (repo *DbUserManagementRepository) UpdateAccessLevel(ctx context.Context, userId int, accessLevel string) (User, error) {
+	if !isAccessLevel(accessLevel) {
+		return User{}, ErrInvalidAccessLevel
+	}
+	user, err := userFromRow(repo.db.QueryRowContext(ctx, sqlUpdateAccessLevel, userId, accessLevel))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (repo *DbUserManagementRepository) DeactivateUser(ctx context.Context, userId int, revokeBefore time.Time) (User, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	user, err := userFromRow(tx.QueryRowContext(ctx, sqlDeactivateUser, userId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
 	if err != nil {
-		repo.logger.Error(err)
+		return User{}, err
+	}
+	if _, err = tx.ExecContext(ctx, sqlRevokeUserTokens, userId, revokeBefore); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func isAccessLevel(accessLevel string) bool {
+	return accessLevel == UserLevel || accessLevel == AdminUserLevel
+}
+
+func userFromRow(row scanner) (user User, err error) {
+	err = row.Scan(&user.Id, &user.AccessLevel, &user.DeactivatedAt)
+	return
+}
+
+const (
+	userKeyFormat            = `%s_user_%d_`
+	userAccessLevelKeyFormat = userKeyFormat + `access_level`
+	userPermissionsKeyFormat = userKeyFormat + `permissions`
+	usersKeyFormat           = `%s_user_`
+)
+
+// CachedUserRepository caches lookups of the repository for ttl. Cached entries of the user must be invalidated,
+// when its access level or roles change, and all entries, when permissions of roles change
+type CachedUserRepository struct {
+	repo      IUserRepository
+	cache     cache.Cache
+	keyPrefix string
+	ttl       time.Duration
+	logger    logger.Logger
+}
+
+func NewCachedUserRepository(repo IUserRepository, cache cache.Cache, keyPrefix string, ttl time.Duration, logger logger.Logger) *CachedUserRepository {
+	return &CachedUserRepository{repo: repo, cache: cache, keyPrefix: keyPrefix, ttl: ttl, logger: logger}
+}
+
+// cachedAccessLevel and cachedPermissions keep the write time of the entry. The ttl of users may be shorter than
+// the ttl of the local cache, which keeps entries on read for its own ttl, so the age is checked on read.
+// A cache miss is told apart by zero StoredAt
+type cachedAccessLevel struct {
+	AccessLevel string
+	// StoredAt is unix time in nanoseconds
+	StoredAt int64
+}
+
+type cachedPermissions struct {
+	Permissions Permissions
+	// StoredAt is unix time in nanoseconds
+	StoredAt int64
+}
+
+// GetAccessLevel and GetPermissions don't cache errors, including ErrUserNotFound
+func (repo *CachedUserRepository) GetAccessLevel(ctx context.Context, userId int) (string, error) {
+	key := fmt.Sprintf(userAccessLevelKeyFormat, repo.keyPrefix, userId)
+	var cached cachedAccessLevel
+	err := repo.cache.Get(ctx, key, &cached)
+	repo.logCacheError(err)
+	if err == nil && repo.isFresh(cached.StoredAt) {
+		return cached.AccessLevel, nil
+	}
+
+	accessLevel, err := repo.repo.GetAccessLevel(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+	cached = cachedAccessLevel{AccessLevel: accessLevel, StoredAt: time.Now().UnixNano()}
+	repo.logCacheError(repo.cache.SetWithTTL(ctx, key, cached, repo.ttl))
+	return accessLevel, nil
+}
+
+func (repo *CachedUserRepository) GetPermissions(ctx context.Context, userId int) (Permissions, error) {
+	key := fmt.Sprintf(userPermissionsKeyFormat, repo.keyPrefix, userId)
+	var cached cachedPermissions
+	err := repo.cache.Get(ctx, key, &cached)
+	repo.logCacheError(err)
+	if err == nil && repo.isFresh(cached.StoredAt) {
+		return cached.Permissions, nil
+	}
+
+	permissions, err := repo.repo.GetPermissions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	cached = cachedPermissions{Permissions: permissions, StoredAt: time.Now().UnixNano()}
+	repo.logCacheError(repo.cache.SetWithTTL(ctx, key, cached, repo.ttl))
+	return permissions, nil
+}
+
+func (repo *CachedUserRepository) isFresh(storedAt int64) bool {
+	return storedAt != 0 && time.Since(time.Unix(0, storedAt)) <= repo.ttl
+}
+
+// InvalidateUser evicts cached entries of the user
+func (repo *CachedUserRepository) InvalidateUser(ctx context.Context, userId int) error {
+	return repo.cache.Delete(ctx,
+		fmt.Sprintf(userAccessLevelKeyFormat, repo.keyPrefix, userId),
+		fmt.Sprintf(userPermissionsKeyFormat, repo.keyPrefix, userId),
+	)
+}
+
+// InvalidateAllUsers evicts cached entries of all users, e.g. after permissions of a role change
+func (repo *CachedUserRepository) InvalidateAllUsers(ctx context.Context) error {
+	return repo.cache.InvalidatePrefix(ctx, fmt.Sprintf(usersKeyFormat, repo.keyPrefix))
+}
+
+// logCacheError logs the cache error, the repository falls back to the db on read errors
+func (repo *CachedUserRepository) logCacheError(err error) {
+	if err != nil {
+		repo.logger.Error(fmt.Errorf("users cache: %w", err))
 	}
-	return accessLevel == AdminUserLevel
 }
 
 type UserRepositoryStub struct {
-	IsAdminStub func(userId int) bool
-	RealAdapter IUserRepository
+	GetAccessLevelStub func(ctx context.Context, userId int) (string, error)
+	GetPermissionsStub func(ctx context.Context, userId int) (Permissions, error)
+	RealAdapter        IUserRepository
+}
+
+func (stub UserRepositoryStub) GetAccessLevel(ctx context.Context, userId int) (string, error) {
+	if stub.GetAccessLevelStub != nil {
+		return stub.GetAccessLevelStub(ctx, userId)
+	}
+	if stub.RealAdapter != nil {
+		return stub.RealAdapter.GetAccessLevel(ctx, userId)
+	}
+	panic("neither GetAccessLevelStub nor RealAdapter are assigned")
 }
 
-func (stub UserRepositoryStub) IsAdmin(userId int) bool {
-	if stub.IsAdminStub != nil {
-		return stub.IsAdminStub(userId)
+func (stub UserRepositoryStub) GetPermissions(ctx context.Context, userId int) (Permissions, error) {
+	if stub.GetPermissionsStub != nil {
+		return stub.GetPermissionsStub(ctx, userId)
 	}
 	if stub.RealAdapter != nil {
-		return stub.RealAdapter.IsAdmin(userId)
+		return stub.RealAdapter.GetPermissions(ctx, userId)
 	}
-	panic("neither IsAdminStub nor RealAdapter are assigned")
+	panic("neither GetPermissionsStub nor RealAdapter are assigned")
 }
@@ -0,0 +1,51 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE FUNCTION notify_data_changes() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'id', OLD.id, 'user_id', OLD.user_id)::text);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'id', NEW.id, 'user_id', NEW.user_id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION notify_users_changes() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'id', OLD.id, 'user_id', OLD.id)::text);
+    ELSE
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'id', NEW.id, 'user_id', NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER data_notify_changes
+    AFTER INSERT OR UPDATE OR DELETE
+    ON data
+    FOR EACH ROW
+EXECUTE FUNCTION notify_data_changes();
+
+CREATE TRIGGER users_notify_changes
+    AFTER INSERT OR UPDATE OR DELETE
+    ON users
+    FOR EACH ROW
+EXECUTE FUNCTION notify_users_changes();
+
+-- +goose Down
+DROP TRIGGER users_notify_changes ON users;
+DROP TRIGGER data_notify_changes ON data;
+DROP FUNCTION notify_users_changes();
+DROP FUNCTION notify_data_changes();
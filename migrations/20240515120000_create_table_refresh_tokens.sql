@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE refresh_tokens
+(
+    id                BIGSERIAL PRIMARY KEY,
+    token_hash        TEXT        NOT NULL UNIQUE,
+    family_id         TEXT        NOT NULL,
+    user_id           BIGINT      NOT NULL REFERENCES users ON DELETE CASCADE,
+    access_jti        TEXT        NOT NULL,
+    access_expires_at TIMESTAMPTZ NOT NULL,
+    expires_at        TIMESTAMPTZ NOT NULL,
+    used_at           TIMESTAMPTZ,
+    revoked_at        TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+-- +goose Down
+DROP TABLE refresh_tokens;
@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE api_keys
+(
+    id           BIGSERIAL PRIMARY KEY,
+    user_id      BIGINT      NOT NULL REFERENCES users ON DELETE CASCADE,
+    key_hash     TEXT        NOT NULL UNIQUE,
+    prefix       TEXT        NOT NULL,
+    name         TEXT        NOT NULL DEFAULT '',
+    scopes       TEXT[]      NOT NULL DEFAULT '{}',
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+-- +goose Down
+DROP TABLE api_keys;
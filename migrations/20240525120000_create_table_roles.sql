@@ -0,0 +1,46 @@
+-- +goose Up
+CREATE TABLE permissions
+(
+    name TEXT PRIMARY KEY
+);
+CREATE TABLE roles
+(
+    name TEXT PRIMARY KEY
+);
+CREATE TABLE role_permissions
+(
+    role       TEXT NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission TEXT NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+-- access_level of the user is the base role, user_roles grant additional ones
+CREATE TABLE user_roles
+(
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+    role    TEXT   NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO permissions (name)
+VALUES ('data:read:own'),
+       ('data:read:all'),
+       ('data:write:own'),
+       ('data:write:all'),
+       ('users:manage');
+INSERT INTO roles (name)
+VALUES ('user'),
+       ('admin');
+INSERT INTO role_permissions (role, permission)
+VALUES ('user', 'data:read:own'),
+       ('user', 'data:write:own'),
+       ('admin', 'data:read:own'),
+       ('admin', 'data:read:all'),
+       ('admin', 'data:write:own'),
+       ('admin', 'data:write:all'),
+       ('admin', 'users:manage');
+
+-- +goose Down
+DROP TABLE user_roles;
+DROP TABLE role_permissions;
+DROP TABLE roles;
+DROP TABLE permissions;
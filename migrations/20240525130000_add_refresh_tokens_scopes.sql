@@ -0,0 +1,6 @@
+-- +goose Up
+-- refresh tokens keep scopes of the token they were issued by
+ALTER TABLE refresh_tokens ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE refresh_tokens DROP COLUMN scopes;
@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE FUNCTION notify_user_roles_changes() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'user_id', OLD.user_id)::text);
+    ELSE
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'user_id', NEW.user_id)::text);
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.user_id <> NEW.user_id THEN
+        PERFORM pg_notify('cache_invalidation',
+                          json_build_object('table', TG_TABLE_NAME, 'user_id', OLD.user_id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION notify_role_permissions_changes() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('cache_invalidation', json_build_object('table', TG_TABLE_NAME)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER user_roles_notify_changes
+    AFTER INSERT OR UPDATE OR DELETE
+    ON user_roles
+    FOR EACH ROW
+EXECUTE FUNCTION notify_user_roles_changes();
+
+CREATE TRIGGER role_permissions_notify_changes
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE
+    ON role_permissions
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_role_permissions_changes();
+
+-- +goose Down
+DROP TRIGGER role_permissions_notify_changes ON role_permissions;
+DROP TRIGGER user_roles_notify_changes ON user_roles;
+DROP FUNCTION notify_role_permissions_changes();
+DROP FUNCTION notify_user_roles_changes();
@@ -0,0 +1,62 @@
+-- +goose Up
+DROP TRIGGER data_notify_changes ON data;
+
+-- +goose StatementBegin
+CREATE FUNCTION notify_data_statement_changes() RETURNS trigger AS
+$$
+DECLARE
+    user_ids BIGINT[];
+    ids      BIGINT[];
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        SELECT array_agg(user_id), array_agg(id) INTO user_ids, ids FROM new_rows;
+    ELSIF TG_OP = 'UPDATE' THEN
+        SELECT array_agg(user_id), array_agg(id) INTO user_ids, ids
+        FROM (SELECT user_id, id FROM old_rows UNION SELECT user_id, id FROM new_rows) changed;
+    ELSE
+        SELECT array_agg(user_id), array_agg(id) INTO user_ids, ids FROM old_rows;
+    END IF;
+    -- one notification per user and 500 records keeps payloads under the limit of pg_notify
+    PERFORM pg_notify('cache_invalidation',
+                      json_build_object('table', TG_TABLE_NAME, 'user_id', user_id, 'ids', array_agg(id ORDER BY id))::text)
+    FROM (SELECT user_id, id, (row_number() OVER (PARTITION BY user_id ORDER BY id) - 1) / 500 AS chunk
+          FROM unnest(user_ids, ids) AS changed(user_id, id)) numbered
+    GROUP BY user_id, chunk;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- transition tables can't be used by triggers with several events
+CREATE TRIGGER data_notify_inserts
+    AFTER INSERT
+    ON data
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_data_statement_changes();
+
+CREATE TRIGGER data_notify_updates
+    AFTER UPDATE
+    ON data
+    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_data_statement_changes();
+
+CREATE TRIGGER data_notify_deletes
+    AFTER DELETE
+    ON data
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_data_statement_changes();
+
+-- +goose Down
+DROP TRIGGER data_notify_deletes ON data;
+DROP TRIGGER data_notify_updates ON data;
+DROP TRIGGER data_notify_inserts ON data;
+DROP FUNCTION notify_data_statement_changes();
+
+CREATE TRIGGER data_notify_changes
+    AFTER INSERT OR UPDATE OR DELETE
+    ON data
+    FOR EACH ROW
+EXECUTE FUNCTION notify_data_changes();
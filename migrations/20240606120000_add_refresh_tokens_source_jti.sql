@@ -0,0 +1,8 @@
+-- +goose Up
+-- refresh tokens keep jti of the provider token they were issued by, so their families are revoked along with it
+ALTER TABLE refresh_tokens ADD COLUMN source_jti TEXT NOT NULL DEFAULT '';
+CREATE INDEX refresh_tokens_source_jti_idx ON refresh_tokens (source_jti);
+
+-- +goose Down
+DROP INDEX refresh_tokens_source_jti_idx;
+ALTER TABLE refresh_tokens DROP COLUMN source_jti;
@@ -13,8 +13,17 @@ func main() {
 	// Please replace the line above with actual import path for auth package.
 	userId := flag.Int("userId", 100, "User Id to generate JWT token for")
 	phrase := flag.String("phrase", "example-phrase", "Secret phrase of JWT token")
+	keysDir := flag.String("keys_dir", "", "Directory of JWT keys, overrides phrase")
+	kid := flag.String("kid", "", "Kid of the signing key from keys_dir, the greatest one by default")
 	flag.Parse()
 	authService := auth.NewJwtService(*phrase) //
+	if *keysDir != "" {
+		keys, err := auth.NewFileKeySet(*keysDir, *kid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authService = auth.NewJwtServiceWithKeys(keys.KeySet)
+	}
 	authService.TokenTTL = 24 * time.Hour
 	if token, err := authService.GenerateToken(*userId); err != nil {
 		log.Fatal(err)